@@ -32,7 +32,17 @@ func (c client) OnJoin(join *twitchchat.Join) {
 	log.Println("Joined: " + join.User)
 }
 
-// A message that was not parsed properly. Generally the welcome messages
+func (c client) OnDisconnected(dis *twitchchat.Disconnected) {
+	log.Println("Disconnected:", dis.Err)
+}
+
+func (c client) OnConnected(con *twitchchat.Connected) {
+	if con.Reconnect {
+		log.Println("Reconnected")
+	}
+}
+
+// A message with a command that is not known
 func (c client) OnRawMsg(raw *twitchchat.RawIrcMessage) {
 	log.Println(string(raw.RawMessage))
 }
@@ -47,11 +57,13 @@ func NewClient(opts *twitchchat.Options) (*client, error) {
 	client := new(client)
 	client.Tc = tc
 
-	tc.RegisterCallback(client.OnPriv)
-	tc.RegisterCallback(client.OnNotice)
-	tc.RegisterCallback(client.OnPart)
-	tc.RegisterCallback(client.OnJoin)
-	tc.RegisterCallback(client.OnRawMsg)
+	twitchchat.On(tc, client.OnPriv)
+	twitchchat.On(tc, client.OnNotice)
+	twitchchat.On(tc, client.OnPart)
+	twitchchat.On(tc, client.OnJoin)
+	twitchchat.On(tc, client.OnRawMsg)
+	twitchchat.On(tc, client.OnDisconnected)
+	twitchchat.On(tc, client.OnConnected)
 
 	return client, nil
 }
@@ -1,6 +1,6 @@
 module github.com/beardsleyn/go-twitch
 
-go 1.14
+go 1.18
 
 require (
 	github.com/gorilla/websocket v1.4.2
@@ -0,0 +1,167 @@
+package twitchchat
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Badge shown next to a user's name, e.g. {"subscriber", "12"}. In the
+// badge info Version holds extra info instead, e.g. the exact number of
+// months subscribed
+type Badge struct {
+	Name    string
+	Version string
+}
+
+// EmoteOccurrence is a single emote in a message. Start and End are the
+// inclusive positions of the emote in the message, counted in unicode
+// code points rather than bytes like twitch does
+type EmoteOccurrence struct {
+	ID    string
+	Start int
+	End   int
+	Text  string
+}
+
+// badges=<badge>/<version>,<badge>/<version>...
+func getBadgesFromTags(tags map[string]string, key string) []Badge {
+	str := getStringFromTags(tags, key)
+	if str == "" {
+		return nil
+	}
+
+	pieces := strings.Split(str, ",")
+	badges := make([]Badge, 0, len(pieces))
+	for _, piece := range pieces {
+		if piece == "" {
+			continue
+		}
+		badge := Badge{Name: piece}
+		if i := strings.IndexByte(piece, '/'); i >= 0 {
+			badge.Name = piece[:i]
+			badge.Version = piece[i+1:]
+		}
+		badges = append(badges, badge)
+	}
+	return badges
+}
+
+// emotes=<id>:<start>-<end>,<start>-<end>/<id>:<start>-<end>...
+// The occurrences are sorted by their position in message
+func getEmotesFromTags(tags map[string]string, key string, message string) []EmoteOccurrence {
+	str := getStringFromTags(tags, key)
+	if str == "" {
+		return nil
+	}
+
+	runes := []rune(message)
+	var emotes []EmoteOccurrence
+	for _, emote := range strings.Split(str, "/") {
+		i := strings.IndexByte(emote, ':')
+		if i < 0 {
+			continue
+		}
+		id := emote[:i]
+
+		for _, position := range strings.Split(emote[i+1:], ",") {
+			j := strings.IndexByte(position, '-')
+			if j < 0 {
+				continue
+			}
+			start, err := strconv.Atoi(position[:j])
+			if err != nil {
+				continue
+			}
+			end, err := strconv.Atoi(position[j+1:])
+			if err != nil {
+				continue
+			}
+
+			occurrence := EmoteOccurrence{
+				ID:    id,
+				Start: start,
+				End:   end,
+			}
+			if start >= 0 && start <= end && end < len(runes) {
+				occurrence.Text = string(runes[start : end+1])
+			}
+			emotes = append(emotes, occurrence)
+		}
+	}
+
+	sort.Slice(emotes, func(i, j int) bool {
+		return emotes[i].Start < emotes[j].Start
+	})
+	return emotes
+}
+
+func hasBadge(badges []Badge, name string) bool {
+	for _, badge := range badges {
+		if badge.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The exact number of months is in the badge info, the badge itself only
+// shows the tier of the badge
+func subscriberMonths(badgeInfo []Badge) int {
+	for _, badge := range badgeInfo {
+		if badge.Name == "subscriber" || badge.Name == "founder" {
+			if months, err := strconv.Atoi(badge.Version); err == nil {
+				return months
+			}
+		}
+	}
+	return 0
+}
+
+func (msg *PrivMsg) IsModerator() bool {
+	return msg.Mod || hasBadge(msg.Badges, "moderator")
+}
+
+func (msg *PrivMsg) IsBroadcaster() bool {
+	return hasBadge(msg.Badges, "broadcaster")
+}
+
+func (msg *PrivMsg) IsVIP() bool {
+	return hasBadge(msg.Badges, "vip")
+}
+
+// SubscriberMonths returns how many months the user has been subscribed,
+// or 0 if they aren't
+func (msg *PrivMsg) SubscriberMonths() int {
+	return subscriberMonths(msg.BadgeInfo)
+}
+
+func (msg *UserNotice) IsModerator() bool {
+	return msg.Mod || hasBadge(msg.Badges, "moderator")
+}
+
+func (msg *UserNotice) IsBroadcaster() bool {
+	return hasBadge(msg.Badges, "broadcaster")
+}
+
+func (msg *UserNotice) IsVIP() bool {
+	return hasBadge(msg.Badges, "vip")
+}
+
+// SubscriberMonths returns how many months the user has been subscribed,
+// or 0 if they aren't
+func (msg *UserNotice) SubscriberMonths() int {
+	return subscriberMonths(msg.BadgeInfo)
+}
+
+func (msg *UserState) IsModerator() bool {
+	return msg.Mod || hasBadge(msg.Badges, "moderator")
+}
+
+func (msg *UserState) IsBroadcaster() bool {
+	return hasBadge(msg.Badges, "broadcaster")
+}
+
+func (msg *UserState) IsVIP() bool {
+	return hasBadge(msg.Badges, "vip")
+}
@@ -0,0 +1,74 @@
+package twitchchat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrivMsgBadges(t *testing.T) {
+	bytes := []byte("@badge-info=subscriber/14;badges=moderator/1,subscriber/12,vip/1;emotes=;mod=0 :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa")
+	msg, ok := bytesToIrcMessage(bytes).(*PrivMsg)
+	if !ok {
+		t.Fatal("PrivMsg unsuccessfully parsed")
+	}
+
+	expected := []Badge{{"moderator", "1"}, {"subscriber", "12"}, {"vip", "1"}}
+	if !reflect.DeepEqual(msg.Badges, expected) {
+		t.Errorf("Wrong badges: %v", msg.Badges)
+	}
+	if !msg.IsModerator() {
+		t.Error("Not a moderator")
+	}
+	if !msg.IsVIP() {
+		t.Error("Not a vip")
+	}
+	if msg.IsBroadcaster() {
+		t.Error("Wrong broadcaster")
+	}
+	if msg.SubscriberMonths() != 14 {
+		t.Error("Wrong subscriber months")
+	}
+	if msg.Emotes != nil {
+		t.Error("Wrong emotes")
+	}
+}
+
+func TestPrivMsgEmotes(t *testing.T) {
+	bytes := []byte("@emotes=25:0-4,12-16/1902:6-10 :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa Keepo Kappa")
+	msg, ok := bytesToIrcMessage(bytes).(*PrivMsg)
+	if !ok {
+		t.Fatal("PrivMsg unsuccessfully parsed")
+	}
+
+	expected := []EmoteOccurrence{
+		{"25", 0, 4, "Kappa"},
+		{"1902", 6, 10, "Keepo"},
+		{"25", 12, 16, "Kappa"},
+	}
+	if !reflect.DeepEqual(msg.Emotes, expected) {
+		t.Errorf("Wrong emotes: %v", msg.Emotes)
+	}
+
+	// Positions count code points, not bytes
+	bytes = []byte("@emotes=25:8-12;badges=broadcaster/1 :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :héllo 🙂 Kappa")
+	msg, ok = bytesToIrcMessage(bytes).(*PrivMsg)
+	if !ok {
+		t.Fatal("PrivMsg unsuccessfully parsed")
+	}
+	if len(msg.Emotes) != 1 || msg.Emotes[0].Text != "Kappa" {
+		t.Errorf("Wrong emotes: %v", msg.Emotes)
+	}
+	if !msg.IsBroadcaster() {
+		t.Error("Not the broadcaster")
+	}
+
+	// Out of range positions don't panic
+	bytes = []byte("@emotes=25:0-40,-1-2,a-b :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa")
+	msg, ok = bytesToIrcMessage(bytes).(*PrivMsg)
+	if !ok {
+		t.Fatal("PrivMsg unsuccessfully parsed")
+	}
+	if len(msg.Emotes) != 1 || msg.Emotes[0].Text != "" {
+		t.Errorf("Wrong emotes: %v", msg.Emotes)
+	}
+}
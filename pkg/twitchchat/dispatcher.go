@@ -0,0 +1,101 @@
+package twitchchat
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a message when the queue it is
+// added to is full
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // Wait for room in the queue
+	OverflowDropNewest                       // Drop the message being added
+	OverflowDropOldest                       // Drop the oldest queued message
+	// Refuse the message being added with an error. Where there is nobody
+	// to return the error to it is dropped like with OverflowDropNewest
+	OverflowReject
+)
+
+// dispatcher hands messages to a pool of workers. All messages of a channel
+// go to the same worker, so they are handled in the order they were received
+type dispatcher struct {
+	handle   func(msg IrcMessage)
+	queues   []chan IrcMessage
+	overflow OverflowPolicy
+	wg       sync.WaitGroup
+}
+
+func newDispatcher(handle func(msg IrcMessage), workers, queueSize int, overflow OverflowPolicy) *dispatcher {
+	d := &dispatcher{
+		handle:   handle,
+		queues:   make([]chan IrcMessage, workers),
+		overflow: overflow,
+	}
+
+	d.wg.Add(workers)
+	for i := range d.queues {
+		d.queues[i] = make(chan IrcMessage, queueSize)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(queue <-chan IrcMessage) {
+	defer d.wg.Done()
+	for msg := range queue {
+		d.handle(msg)
+	}
+}
+
+// dispatch queues msg for the worker of its channel. Messages that aren't
+// sent to a channel, such as whispers and connection events, share a worker
+func (d *dispatcher) dispatch(msg IrcMessage) {
+	queue := d.queueFor(msg)
+
+	switch d.overflow {
+	case OverflowDropNewest, OverflowReject:
+		select {
+		case queue <- msg:
+		default:
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- msg:
+				return
+			default:
+			}
+			select {
+			case <-queue:
+			default:
+			}
+		}
+	default:
+		queue <- msg
+	}
+}
+
+func (d *dispatcher) queueFor(msg IrcMessage) chan IrcMessage {
+	h := fnv.New32a()
+	h.Write([]byte(messageChannel(msg)))
+	return d.queues[h.Sum32()%uint32(len(d.queues))]
+}
+
+// close waits for the queued messages to be handled
+func (d *dispatcher) close() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+// messageChannel returns the channel msg was sent to, or "" if it wasn't
+// sent to a channel
+func messageChannel(msg IrcMessage) string {
+	if raw, ok := msg.(interface{ Raw() *RawIrcMessage }); ok {
+		return getChannel(raw.Raw().RawParams)
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package twitchchat
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func privMsgTo(channel, message string) *PrivMsg {
+	return &PrivMsg{
+		RawIrcMessage: RawIrcMessage{RawParams: [][]byte{[]byte("#" + channel)}},
+		Channel:       channel,
+		Message:       message,
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	block := make(chan struct{})
+	var mutex sync.Mutex
+	received := make(map[string][]string)
+	done := make(chan struct{}, 100)
+
+	d := newDispatcher(func(msg IrcMessage) {
+		priv := msg.(*PrivMsg)
+		if priv.Message == "block" {
+			<-block
+		}
+		mutex.Lock()
+		received[priv.Channel] = append(received[priv.Channel], priv.Message)
+		mutex.Unlock()
+		done <- struct{}{}
+	}, 4, 16, OverflowBlock)
+
+	// Find a channel handled by another worker than the blocked one
+	other := ""
+	for i := 0; other == ""; i++ {
+		c := fmt.Sprint("other", i)
+		if d.queueFor(privMsgTo("slow", "")) != d.queueFor(privMsgTo(c, "")) {
+			other = c
+		}
+	}
+
+	d.dispatch(privMsgTo("slow", "block"))
+	d.dispatch(privMsgTo("slow", "after"))
+	for i := 0; i < 10; i++ {
+		d.dispatch(privMsgTo(other, fmt.Sprint(i)))
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Blocked channel stalled another channel")
+		}
+	}
+
+	close(block)
+	d.close()
+
+	if fmt.Sprint(received["slow"]) != "[block after]" {
+		t.Error("Wrong order: " + fmt.Sprint(received["slow"]))
+	}
+	if fmt.Sprint(received[other]) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Error("Wrong order: " + fmt.Sprint(received[other]))
+	}
+}
+
+func TestDispatcherOverflow(t *testing.T) {
+	for _, test := range []struct {
+		overflow OverflowPolicy
+		expected string
+	}{
+		{OverflowDropNewest, "[block 0 1]"},
+		{OverflowDropOldest, "[block 3 4]"},
+	} {
+		block := make(chan struct{})
+		started := make(chan struct{})
+		var received []string
+
+		d := newDispatcher(func(msg IrcMessage) {
+			priv := msg.(*PrivMsg)
+			if priv.Message == "block" {
+				close(started)
+				<-block
+			}
+			received = append(received, priv.Message)
+		}, 1, 2, test.overflow)
+
+		d.dispatch(privMsgTo("channel", "block"))
+		<-started
+		for i := 0; i < 5; i++ {
+			d.dispatch(privMsgTo("channel", fmt.Sprint(i)))
+		}
+		close(block)
+		d.close()
+
+		if fmt.Sprint(received) != test.expected {
+			t.Errorf("Wrong messages for policy %d: %v", test.overflow, received)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package twitchchat
+
+import (
+	"errors"
+	"time"
+)
+
+// DuplicatePolicy decides what happens to a chat message identical to the
+// previous one sent to the channel less than 30 seconds ago, which twitch
+// rejects. Mods and broadcasters may send duplicates
+type DuplicatePolicy int
+
+const (
+	DuplicateSend   DuplicatePolicy = iota // Send it anyway
+	DuplicateDelay                         // Hold it back until it is no longer a duplicate
+	DuplicateVary                          // Append an invisible character to tell it apart
+	DuplicateReject                        // Fail its result with ErrDuplicate
+)
+
+// How long twitch remembers the previous message sent to a channel
+const duplicateWindow = 30 * time.Second
+
+// Appended to vary a duplicate message. Chat clients don't show the tag space
+const duplicateVariation = " \U000E0000"
+
+// ErrDuplicate is the error of a SendResult that wasn't sent because twitch
+// would reject it as a duplicate
+var ErrDuplicate = errors.New("identical to the previous message sent less than 30 seconds ago")
+
+// duplicatesAllowed reports whether twitch lets the user of state send the
+// same message again within the window, which mods and broadcasters may
+func duplicatesAllowed(state *UserState) bool {
+	return state.IsModerator() || state.IsBroadcaster()
+}
+
+type sentChat struct {
+	message  string
+	at       time.Time
+	previous *sentChat // Last again if twitch rejects this one
+}
+
+// duplicateUntil returns when msg stops being a duplicate, zero if it isn't
+// one. Messages twitch asked to send again were checked the first time
+func (l *chatLimiter) duplicateUntil(msg chatMsg) time.Time {
+	channel := channelKey(msg.channel)
+	last, ok := l.last[channel]
+	if !ok || msg.attempts > 0 || l.duplicatesAllowed[channel] || last.message != msg.message {
+		return time.Time{}
+	}
+	if until := last.at.Add(duplicateWindow); until.After(time.Now()) {
+		return until
+	}
+	return time.Time{}
+}
+
+// unique returns the text to send msg with, so that it isn't rejected as a
+// duplicate
+func (l *chatLimiter) unique(msg chatMsg) (string, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.duplicateUntil(msg).IsZero() {
+		return msg.message, nil
+	}
+	switch l.duplicates {
+	case DuplicateVary:
+		return msg.message + duplicateVariation, nil
+	case DuplicateReject:
+		return "", ErrDuplicate
+	}
+	return msg.message, nil
+}
+
+// unsent forgets message as the last one sent to channel once twitch has
+// rejected it. Twitch compares with the last message it accepted
+func (l *chatLimiter) unsent(channel, message string) {
+	channel = channelKey(channel)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	last, ok := l.last[channel]
+	if !ok || last.message != message {
+		return
+	}
+	if last.previous != nil {
+		l.last[channel] = *last.previous
+	} else {
+		delete(l.last, channel)
+	}
+}
@@ -0,0 +1,80 @@
+package twitchchat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChatLimiterDuplicates(t *testing.T) {
+	l := newChatLimiter(NormalProfile)
+	msg := chatMsg{channel: "dallas", message: "hi"}
+
+	l.sent("#Dallas", "hi")
+	if text, err := l.unique(msg); text != "hi" || err != nil {
+		t.Error("Duplicate not sent: " + text)
+	}
+
+	l.duplicates = DuplicateVary
+	text, _ := l.unique(msg)
+	if text != "hi"+duplicateVariation {
+		t.Error("Duplicate not varied: " + text)
+	}
+	l.sent("dallas", text)
+	if text, _ := l.unique(msg); text != "hi" {
+		t.Error("Varied twice: " + text)
+	}
+	if text, _ := l.unique(chatMsg{channel: "austin", message: "hi"}); text != "hi" {
+		t.Error("Duplicate in other channel: " + text)
+	}
+
+	l.sent("dallas", "hi")
+	l.duplicates = DuplicateReject
+	if _, err := l.unique(msg); err != ErrDuplicate {
+		t.Error("Duplicate not rejected")
+	}
+
+	l.duplicates = DuplicateDelay
+	if d := time.Until(l.pausedUntil(msg)); d < 29*time.Second || d > duplicateWindow {
+		t.Errorf("Wrong duplicate delay: %v", d)
+	}
+	if !l.pausedUntil(chatMsg{channel: "dallas", message: "bye"}).IsZero() {
+		t.Error("Other message delayed")
+	}
+
+	l.last["dallas"] = sentChat{message: "hi", at: time.Now().Add(-duplicateWindow)}
+	if !l.pausedUntil(msg).IsZero() {
+		t.Error("Delayed after the window")
+	}
+
+	l.sent("dallas", "hi")
+	l.observe(&UserState{Channel: "dallas", Badges: []Badge{{Name: "vip", Version: "1"}}})
+	if l.pausedUntil(msg).IsZero() {
+		t.Error("Duplicate not delayed for VIP")
+	}
+	l.observe(&UserState{Channel: "dallas", Mod: true})
+	if !l.pausedUntil(msg).IsZero() {
+		t.Error("Duplicate delayed for mod")
+	}
+}
+
+func TestChatLimiterRejectedDuplicate(t *testing.T) {
+	l := newChatLimiter(NormalProfile)
+	l.duplicates = DuplicateReject
+	msg := chatMsg{channel: "dallas", message: "hi"}
+
+	l.sent("dallas", "bye")
+	l.sent("dallas", "hi")
+	l.unsent("#Dallas", "hi")
+	if _, err := l.unique(msg); err != nil {
+		t.Error("Rejected message counted as sent")
+	}
+	if _, err := l.unique(chatMsg{channel: "dallas", message: "bye"}); err != ErrDuplicate {
+		t.Error("Message before the rejected one forgotten")
+	}
+
+	l.sent("dallas", "hi")
+	msg.attempts = 1
+	if _, err := l.unique(msg); err != nil {
+		t.Error("Retry rejected as duplicate")
+	}
+}
@@ -3,17 +3,39 @@ package twitchchat
 import (
 	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
 var ErrBucketClosed = fmt.Errorf("Error: Sink Closed")
 
+// ErrCoalesced is what an event is dropped with when a newer one with the same
+// coalesce key is added, see EventOptions
+var ErrCoalesced = errors.New("replaced by a newer event")
+
+// ErrBucketFull is what an event is dropped or refused with when the bucket
+// has no room for it, see SetCapacity
+var ErrBucketFull = errors.New("bucket is full")
+
 // inspiration from github.com/Docker/go-events
 type Event interface{}
 
+// Events implementing discarder are told when they are dropped without being
+// emitted
+type discarder interface {
+	discard(err error)
+}
+
+func discard(event Event, err error) {
+	if d, ok := event.(discarder); ok {
+		d.discard(err)
+	}
+}
+
 // Emitter accepts and emits events
 type Emitter interface {
 	// Emit event
@@ -24,97 +46,608 @@ type Emitter interface {
 	Close() error
 }
 
-// Bucket controls the flow of events into the sink
+// Bucket controls the flow of events into the sink. Events are queued per
+// key, see Keyed, and the keys take turns
 type Bucket struct {
 	emitter Emitter
-	events  *list.List
-	cond    *sync.Cond
+	queues  map[string]*queue
+	ring    *list.List    // Keys with queued events, in turn order
+	cursor  *list.Element // Key whose turn it is
+	weights map[string]int
+	pending map[coalesceKey]*list.Element // Queued events to coalesce with
 	mutex   sync.Mutex
-	limiter *rate.Limiter
-	context context.Context
+	limiter RateLimiter
 	closed  bool
+
+	size     int    // Queued events
+	seq      uint64 // Events added so far
+	capacity int
+	overflow OverflowPolicy
+	space    chan struct{} // Closed and replaced when an event is removed
+	onDrop   func(event Event, err error)
+	dropped  []droppedEvent // Reported once the bucket is unlocked
+
+	wake    chan struct{} // Signalled when events are added or the bucket is closed
+	stop    chan struct{} // Closed to stop emitting events
+	stopped chan struct{} // Closed once drip returns
+}
+
+// Events implementing Keyed are queued per key, and the keys take turns so
+// that one busy key can't hold up the others. Other events share a queue
+type Keyed interface {
+	Key() string
+}
+
+type queue struct {
+	key    string
+	events *list.List
+	ring   *list.Element
+	turn   int // Events emitted in the current turn
+}
+
+// Events are only coalesced with events of the same key
+type coalesceKey struct {
+	key      string
+	coalesce string
+}
+
+type queuedEvent struct {
+	event    Event
+	key      string
+	seq      uint64
+	priority Priority
+	coalesce string
+	context  context.Context
+	cancel   context.CancelFunc // Releases the TTL of the event
+	dequeued chan struct{}
+}
+
+// Priority decides which events are emitted first. Events of the same
+// priority are emitted in the order they were added
+type Priority int
+
+const (
+	PriorityLow    Priority = -10
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 10
+)
+
+// EventOptions control how an event is queued
+type EventOptions struct {
+	Priority Priority
+	// The event is dropped if it hasn't been emitted within TTL. Zero means
+	// no limit
+	TTL time.Duration
+	// A queued event with the same Coalesce key and the same Keyed key is
+	// dropped in favour of the new one. Empty means the event isn't coalesced
+	Coalesce string
 }
 
 // Makes a new bucket that can be filled with events. Events are dripped at the
 // passed in rate with given burstLimit. To have no rate limit, rate.Inf should be
 // passed in
 func NewBucket(emitter Emitter, tokenRate rate.Limit, burstLimit int) *Bucket {
+	return NewBucketWithLimiter(emitter, singleLimiter{rate.NewLimiter(tokenRate, burstLimit)})
+}
+
+// RateLimiter decides which limiters an event takes a token from before it
+// is emitted, so that events can be limited differently
+type RateLimiter interface {
+	Limiters(event Event) []*rate.Limiter
+}
+
+// A RateLimiter implementing pauser can hold back events until a given time,
+// on top of its limiters
+type pauser interface {
+	pausedUntil(event Event) time.Time
+}
+
+type singleLimiter struct {
+	limiter *rate.Limiter
+}
+
+func (l singleLimiter) Limiters(event Event) []*rate.Limiter {
+	return []*rate.Limiter{l.limiter}
+}
+
+// Makes a new bucket like NewBucket, with the rate decided per event by
+// limiter
+func NewBucketWithLimiter(emitter Emitter, limiter RateLimiter) *Bucket {
 	bucket := Bucket{
 		emitter: emitter,
-		events:  list.New(),
-		limiter: rate.NewLimiter(tokenRate, burstLimit),
-		context: context.Background(),
+		queues:  make(map[string]*queue),
+		ring:    list.New(),
+		weights: make(map[string]int),
+		pending: make(map[coalesceKey]*list.Element),
+		limiter: limiter,
+		space:   make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
-	bucket.cond = sync.NewCond(&bucket.mutex)
 
 	go bucket.drip()
 	return &bucket
 }
 
-// Add event into bucket. If it's high priority the event will
-// be pushed to the front of the list
+// Add event into bucket. If it's high priority the event will be emitted
+// before the ones of normal priority
 func (bucket *Bucket) AddEvent(event Event, highPriority bool) error {
+	return bucket.AddEventContext(context.Background(), event, highPriority)
+}
+
+// AddEventContext adds event like AddEvent. If ctx is done before the event
+// is emitted, it is removed from the bucket
+func (bucket *Bucket) AddEventContext(ctx context.Context, event Event, highPriority bool) error {
+	opts := EventOptions{Priority: PriorityNormal}
+	if highPriority {
+		opts.Priority = PriorityHigh
+	}
+	return bucket.AddEventWithOptions(ctx, event, opts)
+}
+
+// AddEventWithOptions adds event like AddEventContext, queued as opts says.
+// If the bucket is full, what happens depends on its overflow policy, see
+// SetCapacity
+func (bucket *Bucket) AddEventWithOptions(ctx context.Context, event Event, opts EventOptions) error {
+	return bucket.add(ctx, event, opts, true)
+}
+
+// add queues event. Unless bounded it is queued even if the bucket is full
+func (bucket *Bucket) add(ctx context.Context, event Event, opts EventOptions, bounded bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var key string
+	if keyed, ok := event.(Keyed); ok {
+		key = keyed.Key()
+	}
+	pending := coalesceKey{key, opts.Coalesce}
+
 	bucket.mutex.Lock()
-	defer bucket.mutex.Unlock()
+	for bounded && !bucket.closed && bucket.full(pending) {
+		switch bucket.overflow {
+		case OverflowDropNewest:
+			bucket.dropped = append(bucket.dropped, droppedEvent{event, ErrBucketFull})
+			bucket.unlock()
+			return nil
+		case OverflowReject:
+			bucket.unlock()
+			return ErrBucketFull
+		case OverflowDropOldest:
+			bucket.drop(bucket.oldest(), ErrBucketFull)
+		default:
+			space := bucket.space
+			bucket.unlock()
+			select {
+			case <-space:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			bucket.mutex.Lock()
+		}
+	}
+	defer bucket.unlock()
 
 	if bucket.closed {
 		return ErrBucketClosed
 	}
 
-	if highPriority {
-		bucket.events.PushFront(event)
-	} else {
-		bucket.events.PushBack(event)
+	cancel := func() {}
+	if opts.TTL > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.TTL)
+	}
+	bucket.seq++
+	queued := &queuedEvent{
+		event:    event,
+		key:      key,
+		seq:      bucket.seq,
+		priority: opts.Priority,
+		coalesce: opts.Coalesce,
+		context:  ctx,
+		cancel:   cancel,
+		dequeued: make(chan struct{}),
+	}
+	if old, ok := bucket.pending[pending]; ok && pending.coalesce != "" {
+		bucket.drop(old, ErrCoalesced)
 	}
-	bucket.cond.Signal()
 
+	q, ok := bucket.queues[queued.key]
+	if !ok {
+		q = &queue{
+			key:    queued.key,
+			events: list.New(),
+		}
+		q.ring = bucket.ring.PushBack(q)
+		bucket.queues[q.key] = q
+	}
+
+	// Behind the last event of at least the same priority
+	var elem *list.Element
+	for e := q.events.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*queuedEvent).priority >= queued.priority {
+			elem = q.events.InsertAfter(queued, e)
+			break
+		}
+	}
+	if elem == nil {
+		elem = q.events.PushFront(queued)
+	}
+	if queued.coalesce != "" {
+		bucket.pending[pending] = elem
+	}
+	bucket.size++
+	bucket.signal()
+
+	if ctx.Done() != nil {
+		go bucket.removeWhenDone(elem)
+	}
 	return nil
 }
 
-func (bucket *Bucket) Close() error {
+func (bucket *Bucket) removeWhenDone(elem *list.Element) {
+	queued := elem.Value.(*queuedEvent)
+	select {
+	case <-queued.context.Done():
+		bucket.mutex.Lock()
+		defer bucket.unlock()
+		if isClosed(queued.dequeued) {
+			return
+		}
+		bucket.drop(elem, queued.context.Err())
+	case <-queued.dequeued:
+	}
+}
+
+// full reports whether there is no room for another event. An event
+// replacing one with the same coalesce key takes its room
+func (bucket *Bucket) full(pending coalesceKey) bool {
+	if bucket.capacity <= 0 {
+		return false
+	}
+	size := bucket.size
+	if _, ok := bucket.pending[pending]; ok && pending.coalesce != "" {
+		size--
+	}
+	return size >= bucket.capacity
+}
+
+// oldest returns the queued event that was added first
+func (bucket *Bucket) oldest() *list.Element {
+	var oldest *list.Element
+	for _, q := range bucket.queues {
+		for e := q.events.Front(); e != nil; e = e.Next() {
+			if oldest == nil || e.Value.(*queuedEvent).seq < oldest.Value.(*queuedEvent).seq {
+				oldest = e
+			}
+		}
+	}
+	return oldest
+}
+
+type droppedEvent struct {
+	event Event
+	err   error
+}
+
+// drop removes the event in elem from the bucket without emitting it. It is
+// reported once the bucket is unlocked
+func (bucket *Bucket) drop(elem *list.Element, err error) {
+	queued := elem.Value.(*queuedEvent)
+	bucket.remove(bucket.queues[queued.key], elem)
+	queued.cancel()
+	bucket.dropped = append(bucket.dropped, droppedEvent{queued.event, err})
+}
+
+// report tells event and the OnDrop callback that event was dropped
+func (bucket *Bucket) report(event Event, err error) {
+	bucket.mutex.Lock()
+	bucket.dropped = append(bucket.dropped, droppedEvent{event, err})
+	bucket.unlock()
+}
+
+// unlock unlocks the bucket, then reports the events dropped while it was
+// locked so that they can't call back into the bucket while it is locked
+func (bucket *Bucket) unlock() {
+	dropped := bucket.dropped
+	onDrop := bucket.onDrop
+	bucket.dropped = nil
+	bucket.mutex.Unlock()
+
+	for _, d := range dropped {
+		discard(d.event, d.err)
+		if onDrop != nil {
+			onDrop(d.event, d.err)
+		}
+	}
+}
+
+// remove takes elem out of q, and q out of turn once it is empty
+func (bucket *Bucket) remove(q *queue, elem *list.Element) {
+	queued := elem.Value.(*queuedEvent)
+	q.events.Remove(elem)
+	close(queued.dequeued)
+	pending := coalesceKey{queued.key, queued.coalesce}
+	if bucket.pending[pending] == elem {
+		delete(bucket.pending, pending)
+	}
+	bucket.size--
+	if bucket.capacity > 0 {
+		bucket.freed()
+	}
+
+	if q.events.Len() > 0 {
+		return
+	}
+	if bucket.cursor == q.ring {
+		bucket.cursor = q.ring.Next()
+	}
+	bucket.ring.Remove(q.ring)
+	delete(bucket.queues, q.key)
+}
+
+// freed wakes up the ones waiting for room in the bucket
+func (bucket *Bucket) freed() {
+	close(bucket.space)
+	bucket.space = make(chan struct{})
+}
+
+func (bucket *Bucket) signal() {
+	select {
+	case bucket.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetWeight sets how many events of key are emitted in a row when it is its
+// turn, 1 by default
+func (bucket *Bucket) SetWeight(key string, weight int) {
 	bucket.mutex.Lock()
 	defer bucket.mutex.Unlock()
 
-	if bucket.closed {
+	if weight <= 1 {
+		delete(bucket.weights, key)
+	} else {
+		bucket.weights[key] = weight
+	}
+}
+
+// SetCapacity limits the bucket to capacity queued events, 0 for no limit.
+// overflow decides what happens to events added while it is full. With
+// OverflowBlock adding waits for room until its context is done
+func (bucket *Bucket) SetCapacity(capacity int, overflow OverflowPolicy) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.capacity = capacity
+	bucket.overflow = overflow
+	bucket.freed()
+}
+
+// OnDrop sets a callback called with every event that is dropped without
+// being emitted and the reason it was dropped, such as ErrBucketFull
+func (bucket *Bucket) OnDrop(cb func(event Event, err error)) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.onDrop = cb
+}
+
+// Len returns the number of queued events
+func (bucket *Bucket) Len() int {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	return bucket.size
+}
+
+// QueueLens returns the number of queued events per key. Keys without
+// queued events are left out
+func (bucket *Bucket) QueueLens() map[string]int {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	lens := make(map[string]int, len(bucket.queues))
+	for key, q := range bucket.queues {
+		lens[key] = q.events.Len()
+	}
+	return lens
+}
+
+// Close drops the queued events and waits for an event that is being
+// emitted before closing the emitter
+func (bucket *Bucket) Close() error {
+	bucket.mutex.Lock()
+	if isClosed(bucket.stop) {
+		bucket.mutex.Unlock()
+		<-bucket.stopped
 		return nil
 	}
 
 	bucket.closed = true
-	bucket.cond.Signal()
-	bucket.cond.Wait()
+	close(bucket.stop)
+	bucket.freed()
+	for _, q := range bucket.queues {
+		for e := q.events.Front(); e != nil; e = q.events.Front() {
+			bucket.drop(e, ErrBucketClosed)
+		}
+	}
+	bucket.unlock()
+
+	<-bucket.stopped
 	return bucket.emitter.Close()
 }
 
+// CloseContext stops accepting events and waits for the queued events to be
+// emitted before closing the bucket. Once ctx is done the remaining events
+// are dropped
+func (bucket *Bucket) CloseContext(ctx context.Context) error {
+	bucket.mutex.Lock()
+	bucket.closed = true
+	bucket.signal()
+	bucket.freed()
+	bucket.mutex.Unlock()
+
+	select {
+	case <-bucket.stopped:
+		return bucket.Close()
+	case <-ctx.Done():
+		bucket.Close()
+		return ctx.Err()
+	}
+}
+
 func (bucket *Bucket) drip() {
+	defer close(bucket.stopped)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
 	for {
-		event := bucket.next()
-		if event == nil {
+		queued, readyAt, done := bucket.next()
+		if done {
 			return
 		}
 
-		// Wait for a token before emitting event
-		err := bucket.limiter.Wait(bucket.context)
+		if queued == nil {
+			// Wait for an event to be added or a paused one to be ready
+			if !readyAt.IsZero() {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Until(readyAt))
+			}
+			select {
+			case <-bucket.wake:
+			case <-timer.C:
+			case <-bucket.stop:
+				return
+			}
+			continue
+		}
+
+		// Wait for a token before emitting event. The event is dropped if
+		// its context is done in the meantime
+		err := bucket.wait(queued.context, queued.event)
+		queued.cancel()
 		if err != nil {
-			return
+			bucket.report(queued.event, err)
+			if err == ErrBucketClosed {
+				return
+			}
+			continue
 		}
 
-		if err := bucket.emitter.Emit(event); err != nil {
+		if err := bucket.emitter.Emit(queued.event); err != nil {
 			bucket.emitter.OnError(err)
 		}
 	}
 }
 
-func (bucket *Bucket) next() Event {
+// next takes the first event of the highest priority, and among keys with
+// an event of that priority first the one of the key whose turn it is. Keys
+// whose first event is paused are skipped, if every one is paused readyAt is
+// when the first of them is ready. done is true once the bucket is closed and
+// empty
+func (bucket *Bucket) next() (queued *queuedEvent, readyAt time.Time, done bool) {
 	bucket.mutex.Lock()
 	defer bucket.mutex.Unlock()
 
-	for bucket.events.Len() < 1 {
-		bucket.cond.Wait()
+	if bucket.ring.Len() == 0 {
+		return nil, time.Time{}, bucket.closed
+	}
+	if bucket.cursor == nil {
+		bucket.cursor = bucket.ring.Front()
 	}
 
-	front := bucket.events.Front()
-	event := front.Value.(Event)
-	bucket.events.Remove(front)
+	p, _ := bucket.limiter.(pauser)
+	now := time.Now()
+	var next *queue
+	e := bucket.cursor
+	for i := bucket.ring.Len(); i > 0; i-- {
+		q := e.Value.(*queue)
+		if e = e.Next(); e == nil {
+			e = bucket.ring.Front()
+		}
+		front := q.events.Front().Value.(*queuedEvent)
+
+		if p != nil {
+			if until := p.pausedUntil(front.event); until.After(now) {
+				if readyAt.IsZero() || until.Before(readyAt) {
+					readyAt = until
+				}
+				q.turn = 0
+				continue
+			}
+		}
+		if next == nil || front.priority > next.events.Front().Value.(*queuedEvent).priority {
+			next = q
+		}
+	}
+	if next == nil {
+		return nil, readyAt, false
+	}
 
-	return event
+	// Keys skipped for a higher priority event wait for their turn again
+	if bucket.cursor != next.ring {
+		bucket.cursor.Value.(*queue).turn = 0
+		bucket.cursor = next.ring
+	}
+	next.turn++
+	front := next.events.Front()
+	if next.turn >= bucket.weights[next.key] || next.events.Len() == 1 {
+		next.turn = 0
+		bucket.cursor = bucket.cursor.Next()
+	}
+	bucket.remove(next, front)
+	return front.Value.(*queuedEvent), time.Time{}, false
+}
+
+// wait takes a token from every limiter of event, waiting for the one that
+// takes longest
+func (bucket *Bucket) wait(ctx context.Context, event Event) error {
+	var delay time.Duration
+	var reservations []*rate.Reservation
+	cancel := func() {
+		for _, r := range reservations {
+			r.Cancel()
+		}
+	}
+
+	for _, limiter := range bucket.limiter.Limiters(event) {
+		r := limiter.Reserve()
+		if !r.OK() {
+			cancel()
+			return fmt.Errorf("rate limit allows no events")
+		}
+		reservations = append(reservations, r)
+		if r.Delay() > delay {
+			delay = r.Delay()
+		}
+	}
+
+	if p, ok := bucket.limiter.(pauser); ok {
+		if d := time.Until(p.pausedUntil(event)); d > delay {
+			delay = d
+		}
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	case <-bucket.stop:
+		cancel()
+		return ErrBucketClosed
+	}
 }
@@ -1,6 +1,7 @@
 package twitchchat
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -11,6 +12,7 @@ import (
 
 type testEmitter struct {
 	Emitter
+	mutex  sync.Mutex
 	events []Event
 }
 
@@ -21,10 +23,18 @@ func newTestEmitter(maxEvents int) *testEmitter {
 }
 
 func (te *testEmitter) Emit(event Event) error {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
 	te.events = append(te.events, event)
 	return nil
 }
 
+func (te *testEmitter) emitted() []Event {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+	return append([]Event(nil), te.events...)
+}
+
 func (te *testEmitter) OnError(err error) {
 	// nothing to do
 }
@@ -51,19 +61,246 @@ func TestBucket(t *testing.T) {
 		wg.Add(1)
 		go func(event Event) {
 			if err := bucket.AddEvent(event, false); err != nil {
-				t.Fatalf("Error writing event")
+				t.Errorf("Error writing event")
 			}
 			wg.Done()
 		}("event" + fmt.Sprint((i)))
 	}
 	wg.Wait()
 
+	// Wait for the burst to be emitted, well before the next token
+	deadline := time.Now().Add(rateTime / 2)
+	for len(emitter.emitted()) < burst && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
 	for i := burst; i < numEvents/burst-1; i = i + burst {
-		if len(emitter.events) != i {
-			t.Fatalf("Num events: " + fmt.Sprint(len(emitter.events)) + " expected: " + fmt.Sprint(i))
+		if len(emitter.emitted()) != i {
+			t.Fatalf("Num events: " + fmt.Sprint(len(emitter.emitted())) + " expected: " + fmt.Sprint(i))
 		}
 
 		time.Sleep(rateTime)
 	}
 
 }
+
+func TestBucketContext(t *testing.T) {
+	emitter := newTestEmitter(3)
+	bucket := NewBucket(emitter, rate.Every(50*time.Millisecond), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket.AddEvent("first", false)
+	bucket.AddEventContext(ctx, "cancelled", false)
+	bucket.AddEvent("last", false)
+	cancel()
+
+	if err := bucket.AddEventContext(ctx, "too late", false); err != context.Canceled {
+		t.Error("No error adding event with cancelled context")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if fmt.Sprint(emitter.emitted()) != "[first last]" {
+		t.Error("Wrong events: " + fmt.Sprint(emitter.emitted()))
+	}
+}
+
+func TestBucketClose(t *testing.T) {
+	emitter := newTestEmitter(3)
+	bucket := NewBucket(emitter, rate.Every(20*time.Millisecond), 1)
+	for _, event := range []string{"first", "second", "third"} {
+		bucket.AddEvent(event, false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bucket.CloseContext(ctx); err != nil {
+		t.Error(err)
+	}
+	if fmt.Sprint(emitter.emitted()) != "[first second third]" {
+		t.Error("Wrong events: " + fmt.Sprint(emitter.emitted()))
+	}
+	if err := bucket.AddEvent("closed", false); err != ErrBucketClosed {
+		t.Error("No error adding event to closed bucket")
+	}
+
+	emitter = newTestEmitter(3)
+	bucket = NewBucket(emitter, rate.Every(time.Hour), 1)
+	for _, event := range []string{"first", "second", "third"} {
+		bucket.AddEvent(event, false)
+	}
+	for len(emitter.emitted()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		bucket.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked")
+	}
+	if fmt.Sprint(emitter.emitted()) != "[first]" {
+		t.Error("Wrong events: " + fmt.Sprint(emitter.emitted()))
+	}
+}
+
+type keyedEvent struct {
+	key  string
+	name string
+}
+
+func (e keyedEvent) Key() string {
+	return e.key
+}
+
+func (e keyedEvent) String() string {
+	return e.name
+}
+
+type keyPauser struct {
+	singleLimiter
+	paused map[string]time.Time
+}
+
+func (l keyPauser) pausedUntil(event Event) time.Time {
+	if until, ok := l.paused[event.(keyedEvent).key]; ok {
+		return until
+	}
+	return l.paused[""]
+}
+
+func TestBucketFairness(t *testing.T) {
+	emitter := newTestEmitter(10)
+	// Everything is held up until it has been queued
+	limiter := keyPauser{
+		singleLimiter: singleLimiter{rate.NewLimiter(rate.Inf, 1)},
+		paused: map[string]time.Time{
+			"":     time.Now().Add(50 * time.Millisecond),
+			"slow": time.Now().Add(time.Hour),
+		},
+	}
+	bucket := NewBucketWithLimiter(emitter, limiter)
+	bucket.SetWeight("b", 2)
+
+	for _, e := range []keyedEvent{
+		{"slow", "s1"}, {"a", "a1"}, {"a", "a2"}, {"a", "a3"}, {"b", "b1"}, {"b", "b2"}, {"b", "b3"}, {"c", "c1"},
+	} {
+		bucket.AddEvent(e, false)
+	}
+	if lens := bucket.QueueLens(); fmt.Sprint(lens) != "map[a:3 b:3 c:1 slow:1]" {
+		t.Error("Wrong queue lengths: " + fmt.Sprint(lens))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	emitted := fmt.Sprint(emitter.emitted())
+	if emitted != "[a1 b1 b2 c1 a2 b3 a3]" {
+		t.Error("Wrong order: " + emitted)
+	}
+	if bucket.Len() != 1 {
+		t.Error("Paused event emitted")
+	}
+	bucket.Close()
+}
+
+func TestBucketPriority(t *testing.T) {
+	emitter := newTestEmitter(10)
+	// Everything is held up until it has been queued
+	limiter := keyPauser{
+		singleLimiter: singleLimiter{rate.NewLimiter(rate.Inf, 1)},
+		paused: map[string]time.Time{
+			"": time.Now().Add(50 * time.Millisecond),
+		},
+	}
+	bucket := NewBucketWithLimiter(emitter, limiter)
+
+	ctx := context.Background()
+	for _, e := range []struct {
+		event keyedEvent
+		opts  EventOptions
+	}{
+		{keyedEvent{"a", "timer"}, EventOptions{Priority: PriorityLow}},
+		{keyedEvent{"a", "reply1"}, EventOptions{}},
+		{keyedEvent{"a", "ban1"}, EventOptions{Priority: PriorityHigh}},
+		{keyedEvent{"a", "reply2"}, EventOptions{}},
+		{keyedEvent{"a", "ban2"}, EventOptions{Priority: PriorityHigh}},
+		{keyedEvent{"b", "ban3"}, EventOptions{Priority: PriorityHigh}},
+		{keyedEvent{"b", "expired"}, EventOptions{TTL: 10 * time.Millisecond}},
+		{keyedEvent{"b", "status1"}, EventOptions{Coalesce: "status"}},
+		{keyedEvent{"c", "old"}, EventOptions{Coalesce: "status"}},
+		{keyedEvent{"c", "status2"}, EventOptions{Coalesce: "status"}},
+	} {
+		if err := bucket.AddEventWithOptions(ctx, e.event, e.opts); err != nil {
+			t.Error(err)
+		}
+	}
+	if bucket.Len() != 9 {
+		t.Error("Wrong number of events: " + fmt.Sprint(bucket.Len()))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	emitted := fmt.Sprint(emitter.emitted())
+	if emitted != "[ban1 ban3 ban2 status1 status2 reply1 reply2 timer]" {
+		t.Error("Wrong order: " + emitted)
+	}
+	bucket.Close()
+}
+
+func TestBucketCapacity(t *testing.T) {
+	for _, test := range []struct {
+		overflow OverflowPolicy
+		errors   string
+		dropped  string
+		emitted  string
+	}{
+		{OverflowDropOldest, "[<nil> <nil> <nil>]", "[e1: bucket is full]", "[e2 e3]"},
+		{OverflowDropNewest, "[<nil> <nil> <nil>]", "[e3: bucket is full]", "[e1 e2]"},
+		{OverflowReject, "[<nil> <nil> bucket is full]", "[]", "[e1 e2]"},
+		{OverflowBlock, "[<nil> <nil> context deadline exceeded]", "[]", "[e1 e2]"},
+	} {
+		emitter := newTestEmitter(3)
+		// Everything is held up until it has been queued
+		limiter := keyPauser{
+			singleLimiter: singleLimiter{rate.NewLimiter(rate.Inf, 1)},
+			paused: map[string]time.Time{
+				"": time.Now().Add(50 * time.Millisecond),
+			},
+		}
+		bucket := NewBucketWithLimiter(emitter, limiter)
+		bucket.SetCapacity(2, test.overflow)
+
+		var mutex sync.Mutex
+		dropped := []string{}
+		bucket.OnDrop(func(event Event, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			dropped = append(dropped, fmt.Sprint(event, ": ", err))
+		})
+
+		errs := []error{
+			bucket.AddEvent(keyedEvent{"", "e1"}, false),
+			bucket.AddEvent(keyedEvent{"", "e2"}, false),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.overflow == OverflowBlock {
+			ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+		}
+		errs = append(errs, bucket.AddEventContext(ctx, keyedEvent{"", "e3"}, false))
+		if fmt.Sprint(errs) != test.errors {
+			t.Error("Wrong errors: " + fmt.Sprint(errs))
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		mutex.Lock()
+		if fmt.Sprint(dropped) != test.dropped {
+			t.Error("Wrong dropped events: " + fmt.Sprint(dropped))
+		}
+		mutex.Unlock()
+		if fmt.Sprint(emitter.emitted()) != test.emitted {
+			t.Error("Wrong events: " + fmt.Sprint(emitter.emitted()))
+		}
+		cancel()
+		bucket.Close()
+	}
+}
@@ -0,0 +1,223 @@
+package twitchchat
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// How long to wait for the new connection to join every channel when twitch
+// asks us to reconnect. After that the connections are swapped regardless
+const handoverTimeout = 30 * time.Second
+
+// conn is a single connection to twitch and the channel its messages are
+// received on
+type conn struct {
+	irc  *Irc
+	msgs chan IrcMessage
+	// Ids of messages that were already dispatched from the connection this
+	// one replaced
+	seen map[string]bool
+}
+
+func (tc *TwitchChat) dial(ctx context.Context) (*conn, error) {
+	if err := tc.authLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	irc, err := NewIrc()
+	if err != nil {
+		return nil, err
+	}
+	irc.Transport = tc.options.Transport
+
+	c := &conn{
+		irc:  irc,
+		msgs: make(chan IrcMessage),
+	}
+	err = irc.ConnectContext(ctx, tc.options.Nick, tc.options.Pass, tc.options.EnableTags, c.msgs)
+	if err != nil {
+		go c.discard()
+		return nil, err
+	}
+	return c, nil
+}
+
+// accept answers pings on the connection they arrived on and reports whether
+// msg still has to be dispatched
+func (c *conn) accept(msg IrcMessage) bool {
+	if ping, ok := msg.(*Ping); ok {
+		for _, server := range ping.Servers {
+			c.irc.Pong(server)
+		}
+	}
+
+	if id := messageId(msg); id != "" && c.seen[id] {
+		return false
+	}
+	return true
+}
+
+// discard drops every message until the connection is done
+func (c *conn) discard() {
+	for {
+		select {
+		case <-c.msgs:
+		case <-c.irc.Done():
+			return
+		}
+	}
+}
+
+// forward passes messages from c on to ircChan until the connection drops,
+// handing over to a new connection whenever twitch asks for it. Returns the
+// connection that dropped
+func (tc *TwitchChat) forward(c *conn, ircChan chan<- IrcMessage, stop chan struct{}) *conn {
+	for {
+		select {
+		case msg := <-c.msgs:
+			if !c.accept(msg) {
+				continue
+			}
+			ircChan <- msg
+
+			if _, ok := msg.(*Reconnect); ok {
+				c = tc.handover(c, ircChan, stop)
+			}
+		case <-c.irc.Done():
+			return c
+		}
+	}
+}
+
+// handover opens a second connection and joins every channel on it while
+// still dispatching messages from old. Messages from the new connection are
+// held back until old has been closed and drained, and any that were already
+// dispatched from old are dropped. Returns the connection to continue on,
+// which is old if the new connection couldn't be established
+func (tc *TwitchChat) handover(old *conn, ircChan chan<- IrcMessage, stop chan struct{}) *conn {
+	// Cancelling ctx aborts dialing once the handover has been abandoned
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	dialed := make(chan *conn, 1)
+	go func() {
+		next, _ := tc.dial(ctx)
+		dialed <- next
+	}()
+	abandon := func() {
+		go func() {
+			if next := <-dialed; next != nil {
+				next.irc.Disconnect()
+				next.discard()
+			}
+		}()
+	}
+
+	timeout := time.NewTimer(handoverTimeout)
+	defer timeout.Stop()
+
+	nick := strings.ToLower(tc.options.Nick)
+	seen := make(map[string]bool)
+	pending := make(map[string]bool)
+	var buffered []IrcMessage
+
+	oldMsgs, oldDone := old.msgs, old.irc.Done()
+	var next *conn
+	var nextMsgs chan IrcMessage
+	var nextDone <-chan struct{}
+
+	for next == nil || len(pending) > 0 {
+		select {
+		case msg := <-oldMsgs:
+			if old.accept(msg) {
+				if id := messageId(msg); id != "" {
+					seen[id] = true
+				}
+				ircChan <- msg
+			}
+		case <-oldDone:
+			oldMsgs, oldDone = nil, nil
+		case next = <-dialed:
+			if next == nil {
+				return old
+			}
+			nextMsgs, nextDone = next.msgs, next.irc.Done()
+
+			tc.joinChannelMutex.RLock()
+			for channel := range tc.joinedChannels {
+				pending[channelKey(channel)] = true
+				tc.joinBucket.AddEvent(joinMsg{channel: channel, irc: next.irc}, true)
+			}
+			tc.joinChannelMutex.RUnlock()
+		case msg := <-nextMsgs:
+			next.accept(msg)
+			if join, ok := msg.(*Join); ok && join.Nickname == nick {
+				delete(pending, channelKey(join.Channel))
+			}
+			buffered = append(buffered, msg)
+		case <-nextDone:
+			return old
+		case <-timeout.C:
+			if next == nil {
+				abandon()
+				return old
+			}
+			pending = nil
+		case <-stop:
+			if next == nil {
+				abandon()
+			} else {
+				next.irc.Disconnect()
+				go next.discard()
+			}
+			return old
+		}
+	}
+
+	tc.connMutex.Lock()
+	if isClosed(stop) {
+		tc.connMutex.Unlock()
+		next.irc.Disconnect()
+		go next.discard()
+		return old
+	}
+	tc.irc = next.irc
+	tc.connMutex.Unlock()
+
+	old.irc.Disconnect()
+	for oldDone != nil {
+		select {
+		case msg := <-oldMsgs:
+			if old.accept(msg) {
+				if id := messageId(msg); id != "" {
+					seen[id] = true
+				}
+				ircChan <- msg
+			}
+		case <-oldDone:
+			oldDone = nil
+		}
+	}
+
+	next.seen = seen
+	for _, msg := range buffered {
+		if id := messageId(msg); id == "" || !seen[id] {
+			ircChan <- msg
+		}
+	}
+
+	return next
+}
+
+// messageId returns the unique id twitch gives chat messages and user
+// notices such as *Sub and *Raid, or an empty string for messages without one
+func messageId(msg IrcMessage) string {
+	switch msg := msg.(type) {
+	case *PrivMsg:
+		return msg.Id
+	case userNoticeEvent:
+		return msg.userNotice().Id
+	}
+	return ""
+}
@@ -2,23 +2,51 @@ package twitchchat
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
-
-	"github.com/gorilla/websocket"
+	"sync"
 )
 
+var ErrNotConnected = errors.New("not connected")
+
+// Irc is a single connection to twitch. Once the connection has been
+// dropped a new Irc has to be created to connect again
 type Irc struct {
-	ws      *websocket.Conn
+	// Defaults to TwitchWebsocket
+	Transport Transport
+
+	conn    Conn
 	OutChan chan<- IrcMessage
 	rcvChan chan []byte
+	done    chan struct{}
+	err     error
+
+	writeMutex sync.Mutex
 }
 
 func (irc *Irc) Connect(user string, pass string, tags bool, outChan chan<- IrcMessage) error {
-	sock, _, err := websocket.DefaultDialer.Dial(twitchChatUrl, nil)
+	return irc.ConnectContext(context.Background(), user, pass, tags, outChan)
+}
+
+// ConnectContext connects like Connect, dialing is aborted when ctx is done
+func (irc *Irc) ConnectContext(ctx context.Context, user string, pass string, tags bool, outChan chan<- IrcMessage) error {
+	irc.done = make(chan struct{})
+
+	transport := irc.Transport
+	if transport == nil {
+		transport = TwitchWebsocket
+	}
+
+	sock, err := transport.Dial(ctx)
 	if err != nil {
+		irc.err = err
+		close(irc.done)
 		return err
 	}
-	irc.ws = sock
+	irc.writeMutex.Lock()
+	irc.conn = sock
+	irc.writeMutex.Unlock()
 	irc.OutChan = outChan
 	irc.rcvChan = make(chan []byte)
 
@@ -27,27 +55,31 @@ func (irc *Irc) Connect(user string, pass string, tags bool, outChan chan<- IrcM
 	go func() {
 		defer close(irc.rcvChan)
 		for {
-			_, message, err := irc.ws.ReadMessage()
+			message, err := sock.ReadMessage()
 			if err != nil {
+				irc.err = err
 				return
 			}
 			irc.rcvChan <- message
 		}
 	}()
 
-	err = irc.ws.WriteMessage(websocket.TextMessage, []byte("CAP REQ :twitch.tv/tags twitch.tv/commands twitch.tv/membership"))
+	err = irc.CapReq("twitch.tv/tags twitch.tv/commands twitch.tv/membership")
 	if err != nil {
+		sock.Close()
 		return err
 	}
 
-	err = irc.sendBytes([]byte("PASS oauth:" + pass))
+	err = irc.Send(NewRawIrcMessage("PASS", "oauth:"+pass))
 	if err != nil {
 		log.Println("Couldn't write PASS")
+		sock.Close()
 		return err
 	}
-	err = irc.sendBytes([]byte("NICK " + user))
+	err = irc.Send(NewRawIrcMessage("NICK", user))
 	if err != nil {
 		log.Println("Couldn't write NICK")
+		sock.Close()
 		return err
 	}
 
@@ -55,11 +87,29 @@ func (irc *Irc) Connect(user string, pass string, tags bool, outChan chan<- IrcM
 }
 
 func (irc *Irc) Disconnect() error {
-	return irc.ws.Close()
+	irc.writeMutex.Lock()
+	defer irc.writeMutex.Unlock()
+
+	if irc.conn == nil {
+		return ErrNotConnected
+	}
+	return irc.conn.Close()
+}
+
+// Done is closed once the connection has been dropped and every received
+// message has been passed to OutChan
+func (irc *Irc) Done() <-chan struct{} {
+	return irc.done
+}
+
+// Err returns the error that dropped the connection. Only valid once Done
+// is closed
+func (irc *Irc) Err() error {
+	return irc.err
 }
 
 func (irc *Irc) handleReceivedMessage() {
-	defer close(irc.OutChan)
+	defer close(irc.done)
 	for rcvMsg := range irc.rcvChan {
 		lines := bytes.Split(rcvMsg, []byte("\r\n"))
 		for _, msgBytes := range lines {
@@ -72,28 +122,52 @@ func (irc *Irc) handleReceivedMessage() {
 }
 
 func (irc *Irc) sendBytes(bytes []byte) error {
-	err := irc.ws.WriteMessage(websocket.TextMessage, bytes)
+	irc.writeMutex.Lock()
+	defer irc.writeMutex.Unlock()
+
+	if irc.conn == nil {
+		return ErrNotConnected
+	}
+	err := irc.conn.WriteMessage(bytes)
 	return err
 }
 
+// Send encodes msg and writes it to twitch
+func (irc *Irc) Send(msg *RawIrcMessage) error {
+	bytes, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	return irc.sendBytes(bytes)
+}
+
 func (irc *Irc) Join(channel string) error {
-	return irc.sendBytes([]byte("JOIN #" + channel + "\r\n"))
+	return irc.Send(NewRawIrcMessage("JOIN", "#"+channel))
 }
 
 func (irc *Irc) Part(channel string) error {
-	return irc.sendBytes([]byte("PART #" + channel + "\r\n"))
+	return irc.Send(NewRawIrcMessage("PART", "#"+channel))
 }
 
 func (irc *Irc) Pong(server string) error {
-	return irc.sendBytes([]byte("PONG " + server + "\r\n"))
+	return irc.Send(NewRawIrcMessage("PONG", server))
 }
 
 func (irc *Irc) Privmsg(channel, msg string) error {
-	return irc.sendBytes([]byte("PRIVMSG #" + channel + " :" + msg + "\r\n"))
+	return irc.PrivmsgWithTags(channel, msg, nil)
+}
+
+// PrivmsgWithTags sends msg along with tags such as "reply-parent-msg-id"
+func (irc *Irc) PrivmsgWithTags(channel, msg string, tags map[string]string) error {
+	ircMsg := NewRawIrcMessage("PRIVMSG", "#"+channel, msg)
+	for key, val := range tags {
+		ircMsg.RawTags[key] = val
+	}
+	return irc.Send(ircMsg)
 }
 
 func (irc *Irc) CapReq(req string) error {
-	return nil
+	return irc.Send(NewRawIrcMessage("CAP", "REQ", req))
 }
 
 func NewIrc() (*Irc, error) {
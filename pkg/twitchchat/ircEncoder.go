@@ -0,0 +1,144 @@
+package twitchchat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidMessage = errors.New("invalid irc message")
+
+var tagValueEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+func (cmd MessageCommand) String() string {
+	for str, lookup := range MessageCommandLookup {
+		if lookup == cmd {
+			return str
+		}
+	}
+	return ""
+}
+
+// NewRawIrcMessage makes a message to be sent to twitch. Only the last param
+// may contain spaces
+func NewRawIrcMessage(command string, params ...string) *RawIrcMessage {
+	msg := RawIrcMessage{
+		RawTags:    make(map[string]string),
+		RawCommand: MessageCommandLookup[command],
+		Command:    command,
+		RawParams:  make([][]byte, len(params)),
+	}
+	for i, param := range params {
+		msg.RawParams[i] = []byte(param)
+	}
+	return &msg
+}
+
+// ParseIrcMessage parses a single irc message into one of the message structs,
+// or a *RawIrcMessage if the command isn't known
+func ParseIrcMessage(line []byte) IrcMessage {
+	return bytesToIrcMessage(line)
+}
+
+// Bytes encodes the message as a single "\r\n" terminated line, escaping tag
+// values. Command is used when set, otherwise RawCommand. Tags are sorted by
+// key so the output is stable
+func (msg *RawIrcMessage) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	if len(msg.RawTags) > 0 {
+		keys := make([]string, 0, len(msg.RawTags))
+		for key := range msg.RawTags {
+			if !validTagKey(key) {
+				return nil, fmt.Errorf("%w: tag key %q", ErrInvalidMessage, key)
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(';')
+			}
+			buf.WriteString(key)
+			if val := msg.RawTags[key]; val != "" {
+				buf.WriteByte('=')
+				buf.WriteString(tagValueEscaper.Replace(val))
+			}
+		}
+		buf.WriteByte(' ')
+	}
+
+	if msg.Nickname != "" {
+		buf.WriteByte(':')
+		buf.WriteString(msg.Nickname)
+		if msg.User != "" {
+			buf.WriteByte('!')
+			buf.WriteString(msg.User)
+		}
+		if msg.Host != "" {
+			buf.WriteByte('@')
+			buf.WriteString(msg.Host)
+		}
+		buf.WriteByte(' ')
+	} else if msg.Host != "" {
+		buf.WriteByte(':')
+		buf.WriteString(msg.Host)
+		buf.WriteByte(' ')
+	}
+
+	command := msg.Command
+	if command == "" {
+		command = msg.RawCommand.String()
+	}
+	if command == "" || strings.ContainsAny(command, " \r\n\x00:") {
+		return nil, fmt.Errorf("%w: command %q", ErrInvalidMessage, command)
+	}
+	buf.WriteString(command)
+
+	for i, param := range msg.RawParams {
+		if bytes.ContainsAny(param, "\r\n\x00") {
+			return nil, fmt.Errorf("%w: param %q contains a line break", ErrInvalidMessage, param)
+		}
+
+		buf.WriteByte(' ')
+		trailing := len(param) == 0 || param[0] == ':' || bytes.IndexByte(param, ' ') >= 0
+		if trailing {
+			if i != len(msg.RawParams)-1 {
+				return nil, fmt.Errorf("%w: only the last param may be empty or contain spaces", ErrInvalidMessage)
+			}
+			buf.WriteByte(':')
+		}
+		buf.Write(param)
+	}
+
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+// Tag keys are an optional '+' for client tags, an optional vendor and the
+// name, e.g. "+twitch.tv/reply" or "reply-parent-msg-id"
+func validTagKey(key string) bool {
+	key = strings.TrimPrefix(key, "+")
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package twitchchat
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRawIrcMessageBytes(t *testing.T) {
+	msg := NewRawIrcMessage("PRIVMSG", "#dallas", "Kappa Keepo; Kappa\\")
+	msg.RawTags["reply-parent-msg-id"] = "b34ccfc7-4977-403a-8a94-33c6bac34fb8"
+	msg.RawTags["+client-nonce"] = "a b"
+	bytes, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "@+client-nonce=a\\sb;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8 PRIVMSG #dallas :Kappa Keepo; Kappa\\\r\n"
+	if string(bytes) != expected {
+		t.Errorf("Wrong bytes: %q", bytes)
+	}
+
+	invalid := []*RawIrcMessage{
+		NewRawIrcMessage(""),
+		NewRawIrcMessage("PRIVMSG", "#dallas", "Kappa\r\nPRIVMSG #dallas :Keepo"),
+		NewRawIrcMessage("PRIVMSG", "#dal las", "Kappa"),
+		NewRawIrcMessage("PRIVMSG", "", "Kappa"),
+		{RawTags: map[string]string{"bad key": "a"}, Command: "PING"},
+	}
+	for _, msg := range invalid {
+		if _, err := msg.Bytes(); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("No error encoding %q %q", msg.Command, msg.RawParams)
+		}
+	}
+}
+
+func TestRawIrcMessageRoundTrip(t *testing.T) {
+	lines := []string{
+		"@badge-info=;badges=global_mod/1,turbo/1;color=#0D4200;display-name=ronni;emotes=25:0-4,12-16/1902:6-10;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=0;room-id=1337;subscriber=0;tmi-sent-ts=1507246572675;turbo=1;user-id=1337;user-type=global_mod :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa  Keepo Kappa",
+		"@badge-info=;login=ronni;msg-id=resub;system-msg=ronni\\shas\\ssubscribed\\sfor\\s6\\smonths!\\:) :tmi.twitch.tv USERNOTICE #dallas :Great stream -- keep it up!",
+		"@ban-duration=10 :tmi.twitch.tv CLEARCHAT #dallas :ronni",
+		":ronni!ronni@ronni.tmi.twitch.tv JOIN #dallas",
+		":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands",
+		":tmi.twitch.tv 001 ronni :Welcome, GLHF!",
+		"PING :tmi.twitch.tv",
+		":tmi.twitch.tv RECONNECT",
+	}
+
+	for _, line := range lines {
+		msg := rawIrcMessage(ParseIrcMessage([]byte(line)))
+		bytes, err := msg.Bytes()
+		if err != nil {
+			t.Errorf("Error encoding %q: %v", line, err)
+			continue
+		}
+
+		again := rawIrcMessage(ParseIrcMessage(bytes))
+		if !reflect.DeepEqual(msg.RawTags, again.RawTags) ||
+			msg.ircPrefix != again.ircPrefix ||
+			msg.Command != again.Command ||
+			!reflect.DeepEqual(msg.RawParams, again.RawParams) {
+			t.Errorf("Round trip changed %q to %q", line, bytes)
+		}
+	}
+}
+
+func rawIrcMessage(msg IrcMessage) *RawIrcMessage {
+	return msg.(interface{ Raw() *RawIrcMessage }).Raw()
+}
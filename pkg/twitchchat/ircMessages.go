@@ -2,12 +2,16 @@ package twitchchat
 
 import (
 	"bytes"
-	"log"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// MessageModelVersion is bumped whenever fields of the message structs change
+// type. Version 2 replaced string tag values with typed ones. The tags as
+// received are always available in RawTags
+const MessageModelVersion = 2
+
 type MessageCommand int
 
 const (
@@ -25,6 +29,18 @@ const (
 	ROOMSTATE
 	USERNOTICE
 	USERSTATE
+	WHISPER
+	CAP
+	RPL_WELCOME
+	RPL_YOURHOST
+	RPL_CREATED
+	RPL_MYINFO
+	RPL_NAMREPLY
+	RPL_ENDOFNAMES
+	RPL_MOTD
+	RPL_MOTDSTART
+	RPL_ENDOFMOTD
+	ERR_UNKNOWNCOMMAND
 )
 
 var MessageCommandLookup = map[string]MessageCommand{
@@ -41,6 +57,18 @@ var MessageCommandLookup = map[string]MessageCommand{
 	"ROOMSTATE":       ROOMSTATE,
 	"USERNOTICE":      USERNOTICE,
 	"USERSTATE":       USERSTATE,
+	"WHISPER":         WHISPER,
+	"CAP":             CAP,
+	"001":             RPL_WELCOME,
+	"002":             RPL_YOURHOST,
+	"003":             RPL_CREATED,
+	"004":             RPL_MYINFO,
+	"353":             RPL_NAMREPLY,
+	"366":             RPL_ENDOFNAMES,
+	"372":             RPL_MOTD,
+	"375":             RPL_MOTDSTART,
+	"376":             RPL_ENDOFMOTD,
+	"421":             ERR_UNKNOWNCOMMAND,
 }
 
 type ircPrefix struct {
@@ -54,7 +82,18 @@ type RawIrcMessage struct {
 	RawTags    map[string]string
 	ircPrefix
 	RawCommand MessageCommand
+	Command    string // As received, also set for UNKNOWN commands
 	RawParams  [][]byte
+	// Set by middleware, see Annotate
+	Annotations map[string]interface{}
+}
+
+func (msg *RawIrcMessage) ircMessage() {}
+
+// Raw returns the message as it was parsed. Every message struct embeds a
+// RawIrcMessage, so this gives access to the tags and params of any of them
+func (msg *RawIrcMessage) Raw() *RawIrcMessage {
+	return msg
 }
 
 type ClearChat struct {
@@ -74,14 +113,14 @@ type ClearMsg struct {
 
 type GlobalUserState struct {
 	RawIrcMessage
-	BadgeInfo   string
-	Badges      string
-	Color       string
+	BadgeInfo   []Badge
+	Badges      []Badge
+	Color       Color
 	DisplayName string
-	EmoteSets   string
-	Turbo       string
+	EmoteSets   []string
+	Turbo       bool
 	UserId      string
-	UserType    string
+	UserType    UserType
 }
 
 type HostTarget struct {
@@ -115,24 +154,26 @@ type Ping struct {
 
 type PrivMsg struct {
 	RawIrcMessage
-	BadgeInfo   string
-	Badges      string
-	Bits        string
+	BadgeInfo   []Badge
+	Badges      []Badge
+	Bits        int
 	Channel     string
-	Color       string
+	Color       Color
 	DisplayName string
-	Emotes      string
+	Emotes      []EmoteOccurrence
 	Id          string
 	Message     string
-	Mod         string
+	Mod         bool
 	RoomId      string
-	Subscriber  string
-	TmiSentTs   string
-	Turbo       string
+	Subscriber  bool
+	TmiSentTs   time.Time
+	Turbo       bool
 	UserId      string
-	UserType    string
+	UserType    UserType
 }
 
+// Reconnect is sent by twitch before it drops the connection. TwitchChat
+// handles it by moving over to a new connection without losing messages
 type Reconnect struct {
 	RawIrcMessage
 }
@@ -149,65 +190,53 @@ type RoomState struct {
 
 type UserNotice struct {
 	RawIrcMessage
-	BadgeInfo   string
-	Badges      string
+	BadgeInfo   []Badge
+	Badges      []Badge
 	Channel     string
-	Color       string
+	Color       Color
 	DisplayName string
-	Emotes      string
+	Emotes      []EmoteOccurrence
 	Id          string
 	Login       string
 	Message     string
-	Mod         string
+	Mod         bool
 	MsgId       string
 	RoomId      string
 	Subscriber  bool
 	SystemMsg   string
-	TmiSentTs   string
-	Turbo       string
+	TmiSentTs   time.Time
+	Turbo       bool
 	UserId      string
-	UserType    string
-
-	// On Sub.Resub
-	// MsgParamCumulativeMonths string
-
-	// // On Raid
-	// MsgParamDisplayName string
-	// MsgParamLogin       string
-
-	// // On Subgift/anonsubgift
-	// MsgParamMonths string
-
-	// // anongiftpaidupgrade/giftpaidupgrade
-	// MsgParamPromoGiftTotal       string
-	// MsgParamPromoName            string
-	// MsgParamRecipientDisplayName string
-	// MsgParamRecipientId          string
-	// MsgParamRecipientUserName    string
-	// MsgParamSenderLogin          string
-	// MsgParamSenderName           string
-	// MsgParamShouldShareStreak    string
-	// MsgParamStreakMonths         string
-	// MsgParamSubPlan              string
-	// MsgParamSubPlanName          string
-	// MsgParamViewerCount          string
-	// MsgParamRitualName           string
-	// MsgParamThreshold            string
-	// MsgParamGiftMonths           string
+	UserType    UserType
 }
 
 type UserState struct {
 	RawIrcMessage
-	BadgeInfo   string
-	Badges      string
+	BadgeInfo   []Badge
+	Badges      []Badge
 	Channel     string
-	Color       string
+	Color       Color
 	DisplayName string
-	EmoteSets   string
-	Mod         string
+	EmoteSets   []string
+	Mod         bool
 	Subscriber  bool
-	Turbo       string
-	UserType    string
+	Turbo       bool
+	UserType    UserType
+}
+
+type Whisper struct {
+	RawIrcMessage
+	Badges      []Badge
+	Color       Color
+	DisplayName string
+	Emotes      []EmoteOccurrence
+	Message     string
+	MessageId   string
+	Target      string // Login of the user the whisper was sent to
+	ThreadId    string
+	Turbo       bool
+	UserId      string
+	UserType    UserType
 }
 
 func getStringFromTags(tags map[string]string, key string) string {
@@ -227,6 +256,13 @@ func getChannel(params [][]byte) string {
 	return ""
 }
 
+func getParam(params [][]byte, i int) string {
+	if len(params) > i {
+		return string(params[i])
+	}
+	return ""
+}
+
 func getUintFromTags(tags map[string]string, key string) uint {
 	str := getStringFromTags(tags, key)
 	if str != "" {
@@ -266,9 +302,7 @@ func newClearChatMsg(rawMsg RawIrcMessage) *ClearChat {
 	}
 
 	if len(rawMsg.RawParams) > 1 {
-		if bytes.HasPrefix(rawMsg.RawParams[1], []byte(":")) {
-			msg.User = string(rawMsg.RawParams[1][1:])
-		}
+		msg.User = string(rawMsg.RawParams[1])
 	}
 
 	return &msg
@@ -282,10 +316,9 @@ func newClearMsgMsg(rawMsg RawIrcMessage) *ClearMsg {
 		TargetMsgId:   getStringFromTags(rawMsg.RawTags, "target-msg-id"),
 	}
 
-	// Params[0] should be the Channel, the rest are the message
+	// Params[0] should be the Channel, Params[1] the message
 	if len(msg.RawParams) > 1 {
-		msg.Message = string(bytes.Join(msg.RawParams[1:], []byte(" ")))
-		msg.Message = strings.TrimPrefix(msg.Message, ":")
+		msg.Message = string(msg.RawParams[1])
 	}
 
 	return &msg
@@ -294,14 +327,14 @@ func newClearMsgMsg(rawMsg RawIrcMessage) *ClearMsg {
 func newGlobalUserStateMsg(rawMsg RawIrcMessage) *GlobalUserState {
 	msg := GlobalUserState{
 		RawIrcMessage: rawMsg,
-		BadgeInfo:     getStringFromTags(rawMsg.RawTags, "badge-info"),
-		Badges:        getStringFromTags(rawMsg.RawTags, "badges"),
-		Color:         getStringFromTags(rawMsg.RawTags, "color"),
+		BadgeInfo:     getBadgesFromTags(rawMsg.RawTags, "badge-info"),
+		Badges:        getBadgesFromTags(rawMsg.RawTags, "badges"),
+		Color:         getColorFromTags(rawMsg.RawTags, "color"),
 		DisplayName:   getStringFromTags(rawMsg.RawTags, "display-name"),
-		EmoteSets:     getStringFromTags(rawMsg.RawTags, "emote-sets"),
-		Turbo:         getStringFromTags(rawMsg.RawTags, "turbo"),
+		EmoteSets:     getListFromTags(rawMsg.RawTags, "emote-sets"),
+		Turbo:         getBoolFromTags(rawMsg.RawTags, "turbo"),
 		UserId:        getStringFromTags(rawMsg.RawTags, "user-id"),
-		UserType:      getStringFromTags(rawMsg.RawTags, "user-type"),
+		UserType:      getUserTypeFromTags(rawMsg.RawTags, "user-type"),
 	}
 
 	return &msg
@@ -313,13 +346,17 @@ func newHostTargetMsg(rawMsg RawIrcMessage) *HostTarget {
 		Channel:       getChannel(rawMsg.RawParams),
 	}
 
+	// Params[1] is "<target channel> <number of viewers>". The target is
+	// "-" when hosting stops
 	if len(rawMsg.RawParams) > 1 {
-		msg.TargetChannel = string(bytes.TrimPrefix(rawMsg.RawParams[1], []byte(":")))
-	}
-
-	if len(rawMsg.RawParams) > 2 {
-		if num, err := strconv.ParseUint(string(rawMsg.RawParams[2]), 10, 32); err == nil {
-			msg.NumberOfViewers = uint(num)
+		target := bytes.Fields(rawMsg.RawParams[1])
+		if len(target) > 0 {
+			msg.TargetChannel = string(target[0])
+		}
+		if len(target) > 1 {
+			if num, err := strconv.ParseUint(string(target[1]), 10, 32); err == nil {
+				msg.NumberOfViewers = uint(num)
+			}
 		}
 	}
 
@@ -342,10 +379,9 @@ func newNoticeMsg(rawMsg RawIrcMessage) *Notice {
 		MsgId:         getStringFromTags(rawMsg.RawTags, "msg-id"),
 	}
 
-	// Params[0] should be the Channel, the rest are the message
+	// Params[0] should be the Channel, Params[1] the message
 	if len(msg.RawParams) > 1 {
-		msg.Message = string(bytes.Join(msg.RawParams[1:], []byte(" ")))
-		msg.Message = strings.TrimPrefix(msg.Message, ":")
+		msg.Message = string(msg.RawParams[1])
 	}
 
 	return &msg
@@ -376,28 +412,27 @@ func newPingMsg(rawMsg RawIrcMessage) *Ping {
 func newPrivMsgMsg(rawMsg RawIrcMessage) *PrivMsg {
 	msg := PrivMsg{
 		RawIrcMessage: rawMsg,
-		BadgeInfo:     getStringFromTags(rawMsg.RawTags, "badge-info"),
-		Badges:        getStringFromTags(rawMsg.RawTags, "badges"),
-		Bits:          getStringFromTags(rawMsg.RawTags, "bits"),
+		BadgeInfo:     getBadgesFromTags(rawMsg.RawTags, "badge-info"),
+		Badges:        getBadgesFromTags(rawMsg.RawTags, "badges"),
+		Bits:          getIntFromTags(rawMsg.RawTags, "bits"),
 		Channel:       getChannel(rawMsg.RawParams),
-		Color:         getStringFromTags(rawMsg.RawTags, "color"),
+		Color:         getColorFromTags(rawMsg.RawTags, "color"),
 		DisplayName:   getStringFromTags(rawMsg.RawTags, "display-name"),
-		Emotes:        getStringFromTags(rawMsg.RawTags, "emotes"),
 		Id:            getStringFromTags(rawMsg.RawTags, "id"),
-		Mod:           getStringFromTags(rawMsg.RawTags, "mod"),
+		Mod:           getBoolFromTags(rawMsg.RawTags, "mod"),
 		RoomId:        getStringFromTags(rawMsg.RawTags, "room-id"),
-		Subscriber:    getStringFromTags(rawMsg.RawTags, "subscriber"),
-		TmiSentTs:     getStringFromTags(rawMsg.RawTags, "tmi-sent-ts"),
-		Turbo:         getStringFromTags(rawMsg.RawTags, "turbo"),
+		Subscriber:    getBoolFromTags(rawMsg.RawTags, "subscriber"),
+		TmiSentTs:     getTimeFromTags(rawMsg.RawTags, "tmi-sent-ts"),
+		Turbo:         getBoolFromTags(rawMsg.RawTags, "turbo"),
 		UserId:        getStringFromTags(rawMsg.RawTags, "user-id"),
-		UserType:      getStringFromTags(rawMsg.RawTags, "user-type"),
+		UserType:      getUserTypeFromTags(rawMsg.RawTags, "user-type"),
 	}
 
-	// Params[0] should be the Channel, the rest are the message
+	// Params[0] should be the Channel, Params[1] the message
 	if len(msg.RawParams) > 1 {
-		msg.Message = string(bytes.Join(msg.RawParams[1:], []byte(" ")))
-		msg.Message = strings.TrimPrefix(msg.Message, ":")
+		msg.Message = string(msg.RawParams[1])
 	}
+	msg.Emotes = getEmotesFromTags(rawMsg.RawTags, "emotes", msg.Message)
 
 	return &msg
 }
@@ -413,8 +448,9 @@ func newReconnectMsg(rawMsg RawIrcMessage) *Reconnect {
 func newRoomStateMsg(rawMsg RawIrcMessage) *RoomState {
 	msg := RoomState{
 		RawIrcMessage: rawMsg,
+		Channel:       getChannel(rawMsg.RawParams),
 		EmoteOnly:     getBoolFromTags(rawMsg.RawTags, "emote-only"),
-		FollowersOnly: getIntFromTags(rawMsg.RawTags, "emote-only"),
+		FollowersOnly: getIntFromTags(rawMsg.RawTags, "followers-only"),
 		R9K:           getBoolFromTags(rawMsg.RawTags, "r9k"),
 		Slow:          getUintFromTags(rawMsg.RawTags, "slow"),
 		SubsOnly:      getBoolFromTags(rawMsg.RawTags, "subs-only"),
@@ -426,29 +462,29 @@ func newRoomStateMsg(rawMsg RawIrcMessage) *RoomState {
 func newUserNoticeMsg(rawMsg RawIrcMessage) *UserNotice {
 	msg := UserNotice{
 		RawIrcMessage: rawMsg,
-		BadgeInfo:     getStringFromTags(rawMsg.RawTags, "badge-info"),
-		Badges:        getStringFromTags(rawMsg.RawTags, "badges"),
+		BadgeInfo:     getBadgesFromTags(rawMsg.RawTags, "badge-info"),
+		Badges:        getBadgesFromTags(rawMsg.RawTags, "badges"),
 		Channel:       getChannel(rawMsg.RawParams),
-		Color:         getStringFromTags(rawMsg.RawTags, "color"),
+		Color:         getColorFromTags(rawMsg.RawTags, "color"),
 		DisplayName:   getStringFromTags(rawMsg.RawTags, "display-name"),
-		Emotes:        getStringFromTags(rawMsg.RawTags, "emotes"),
 		Id:            getStringFromTags(rawMsg.RawTags, "id"),
 		Login:         getStringFromTags(rawMsg.RawTags, "login"),
-		Mod:           getStringFromTags(rawMsg.RawTags, "mod"),
+		Mod:           getBoolFromTags(rawMsg.RawTags, "mod"),
 		MsgId:         getStringFromTags(rawMsg.RawTags, "msg-id"),
 		RoomId:        getStringFromTags(rawMsg.RawTags, "room-id"),
 		Subscriber:    getBoolFromTags(rawMsg.RawTags, "subscriber"),
-		TmiSentTs:     getStringFromTags(rawMsg.RawTags, "tmi-sent-ts"),
-		Turbo:         getStringFromTags(rawMsg.RawTags, "turbo"),
+		SystemMsg:     getStringFromTags(rawMsg.RawTags, "system-msg"),
+		TmiSentTs:     getTimeFromTags(rawMsg.RawTags, "tmi-sent-ts"),
+		Turbo:         getBoolFromTags(rawMsg.RawTags, "turbo"),
 		UserId:        getStringFromTags(rawMsg.RawTags, "user-id"),
-		UserType:      getStringFromTags(rawMsg.RawTags, "user-type"),
+		UserType:      getUserTypeFromTags(rawMsg.RawTags, "user-type"),
 	}
 
-	// Params[0] should be the Channel, the rest are the message
+	// Params[0] should be the Channel, Params[1] the message
 	if len(msg.RawParams) > 1 {
-		msg.Message = string(bytes.Join(msg.RawParams[1:], []byte(" ")))
-		msg.Message = strings.TrimPrefix(msg.Message, ":")
+		msg.Message = string(msg.RawParams[1])
 	}
+	msg.Emotes = getEmotesFromTags(rawMsg.RawTags, "emotes", msg.Message)
 
 	return &msg
 }
@@ -456,18 +492,39 @@ func newUserNoticeMsg(rawMsg RawIrcMessage) *UserNotice {
 func newUserStateMsg(rawMsg RawIrcMessage) *UserState {
 	msg := UserState{
 		RawIrcMessage: rawMsg,
-		BadgeInfo:     getStringFromTags(rawMsg.RawTags, "badge-info"),
-		Badges:        getStringFromTags(rawMsg.RawTags, "badges"),
+		BadgeInfo:     getBadgesFromTags(rawMsg.RawTags, "badge-info"),
+		Badges:        getBadgesFromTags(rawMsg.RawTags, "badges"),
 		Channel:       getChannel(rawMsg.RawParams),
-		Color:         getStringFromTags(rawMsg.RawTags, "color"),
+		Color:         getColorFromTags(rawMsg.RawTags, "color"),
 		DisplayName:   getStringFromTags(rawMsg.RawTags, "display-name"),
-		EmoteSets:     getStringFromTags(rawMsg.RawTags, "emote-sets"),
-		Mod:           getStringFromTags(rawMsg.RawTags, "mod"),
+		EmoteSets:     getListFromTags(rawMsg.RawTags, "emote-sets"),
+		Mod:           getBoolFromTags(rawMsg.RawTags, "mod"),
 		Subscriber:    getBoolFromTags(rawMsg.RawTags, "subscriber"),
-		Turbo:         getStringFromTags(rawMsg.RawTags, "turbo"),
-		UserType:      getStringFromTags(rawMsg.RawTags, "user-type"),
+		Turbo:         getBoolFromTags(rawMsg.RawTags, "turbo"),
+		UserType:      getUserTypeFromTags(rawMsg.RawTags, "user-type"),
+	}
+
+	return &msg
+}
+
+func newWhisperMsg(rawMsg RawIrcMessage) *Whisper {
+	msg := Whisper{
+		RawIrcMessage: rawMsg,
+		Badges:        getBadgesFromTags(rawMsg.RawTags, "badges"),
+		Color:         getColorFromTags(rawMsg.RawTags, "color"),
+		DisplayName:   getStringFromTags(rawMsg.RawTags, "display-name"),
+		MessageId:     getStringFromTags(rawMsg.RawTags, "message-id"),
+		Target:        getParam(rawMsg.RawParams, 0),
+		ThreadId:      getStringFromTags(rawMsg.RawTags, "thread-id"),
+		Turbo:         getBoolFromTags(rawMsg.RawTags, "turbo"),
+		UserId:        getStringFromTags(rawMsg.RawTags, "user-id"),
+		UserType:      getUserTypeFromTags(rawMsg.RawTags, "user-type"),
 	}
 
+	// Params[0] should be the Target, Params[1] the message
+	msg.Message = getParam(rawMsg.RawParams, 1)
+	msg.Emotes = getEmotesFromTags(rawMsg.RawTags, "emotes", msg.Message)
+
 	return &msg
 }
 
@@ -503,14 +560,25 @@ func newIrcMessage(rawMsg RawIrcMessage) IrcMessage {
 	case ROOMSTATE:
 		rval = newRoomStateMsg(rawMsg)
 	case USERNOTICE:
-		rval = newUserNoticeMsg(rawMsg)
+		rval = newUserNoticeEvent(newUserNoticeMsg(rawMsg))
 	case USERSTATE:
 		rval = newUserStateMsg(rawMsg)
+	case WHISPER:
+		rval = newWhisperMsg(rawMsg)
+	case CAP:
+		rval = newCapMsg(rawMsg)
+	case RPL_WELCOME, RPL_YOURHOST, RPL_CREATED, RPL_MYINFO,
+		RPL_NAMREPLY, RPL_ENDOFNAMES, RPL_MOTD, RPL_MOTDSTART, RPL_ENDOFMOTD,
+		ERR_UNKNOWNCOMMAND:
+		rval = newReplyMsg(rawMsg)
 	}
 
 	return rval
 }
 
+// Parses a single irc message as described in
+// https://ircv3.net/specs/extensions/message-tags and RFC 1459
+// @<tags> :<prefix> <command> <params> :<trailing param>
 func bytesToIrcMessage(buffer []byte) IrcMessage {
 
 	rawMsg := RawIrcMessage{
@@ -519,51 +587,118 @@ func bytesToIrcMessage(buffer []byte) IrcMessage {
 		RawTags:    make(map[string]string),
 	}
 
-	msgPieces := bytes.Split(buffer, []byte(" "))
-	currentIndex := 0
+	line := bytes.TrimLeft(bytes.TrimRight(buffer, "\r\n"), " ")
 
 	// Tags are included
 	// @<key>=<val>;<key>=<val>....
-	if bytes.HasPrefix(msgPieces[currentIndex], []byte("@")) {
-		msgPieces[currentIndex] = bytes.TrimPrefix(msgPieces[currentIndex], []byte("@"))
-		tags := bytes.Split(msgPieces[currentIndex], []byte(";"))
-		for i := range tags {
-			keyVal := bytes.Split(tags[i], []byte("="))
-			if len(keyVal) == 2 {
-				rawMsg.RawTags[string(keyVal[0])] = string(keyVal[1])
+	if len(line) > 0 && line[0] == '@' {
+		var tags []byte
+		tags, line = nextToken(line[1:])
+		for _, tag := range bytes.Split(tags, []byte(";")) {
+			if len(tag) == 0 {
+				continue
+			}
+
+			key, val := tag, []byte(nil)
+			if i := bytes.IndexByte(tag, '='); i >= 0 {
+				key, val = tag[:i], tag[i+1:]
 			}
+			rawMsg.RawTags[string(key)] = unescapeTagValue(val)
 		}
-		currentIndex++
 	}
 
 	// Message contains source information
 	// :tmi.twitch.tv or :<user>!<user>@<user>.tmi.twitch.tv
-	if bytes.HasPrefix(msgPieces[currentIndex], []byte(":")) {
-		msgPieces[currentIndex] = bytes.TrimPrefix(msgPieces[currentIndex], []byte(":"))
-
-		pieces := regexp.MustCompile(`!|@`).Split(string(msgPieces[currentIndex]), -1)
-
-		switch len(pieces) {
-		case 1:
-			rawMsg.Host = pieces[0]
-		case 3:
-			rawMsg.Nickname = pieces[0]
-			rawMsg.User = pieces[1]
-			rawMsg.Host = pieces[2]
-		default:
-			log.Println(pieces)
-		}
-		currentIndex++
+	if len(line) > 0 && line[0] == ':' {
+		var prefix []byte
+		prefix, line = nextToken(line[1:])
+		rawMsg.ircPrefix = parsePrefix(string(prefix))
 	}
 
-	if len(msgPieces) > currentIndex {
-		rawMsg.RawCommand = MessageCommandLookup[string(msgPieces[currentIndex])]
-		currentIndex++
+	var command []byte
+	command, line = nextToken(line)
+	if len(command) > 0 {
+		rawMsg.Command = string(command)
+		rawMsg.RawCommand = MessageCommandLookup[rawMsg.Command]
 	}
 
-	if len(msgPieces) > currentIndex {
-		rawMsg.RawParams = msgPieces[currentIndex:]
+	// Everything after a ':' is a single param, spaces included
+	for len(line) > 0 {
+		if line[0] == ':' {
+			rawMsg.RawParams = append(rawMsg.RawParams, line[1:])
+			break
+		}
+
+		var param []byte
+		param, line = nextToken(line)
+		rawMsg.RawParams = append(rawMsg.RawParams, param)
 	}
 
 	return newIrcMessage(rawMsg)
 }
+
+// nextToken splits line at the first space, dropping any spaces that follow
+func nextToken(line []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return line, nil
+	}
+	return line[:i], bytes.TrimLeft(line[i+1:], " ")
+}
+
+// Prefix is either a server name or <nick>[!<user>][@<host>]
+func parsePrefix(prefix string) ircPrefix {
+	var rval ircPrefix
+
+	if i := strings.IndexByte(prefix, '@'); i >= 0 {
+		rval.Host = prefix[i+1:]
+		prefix = prefix[:i]
+	} else if strings.IndexByte(prefix, '!') < 0 {
+		rval.Host = prefix
+		return rval
+	}
+
+	if i := strings.IndexByte(prefix, '!'); i >= 0 {
+		rval.User = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+	rval.Nickname = prefix
+
+	return rval
+}
+
+// Tag values escape characters that would break up the tags, see
+// https://ircv3.net/specs/extensions/message-tags#escaping-values
+func unescapeTagValue(val []byte) string {
+	if bytes.IndexByte(val, '\\') < 0 {
+		return string(val)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' {
+			sb.WriteByte(val[i])
+			continue
+		}
+
+		i++
+		if i == len(val) {
+			// A trailing backslash is dropped
+			break
+		}
+		switch val[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			// Covers \\ as well as unknown escapes, which drop the backslash
+			sb.WriteByte(val[i])
+		}
+	}
+	return sb.String()
+}
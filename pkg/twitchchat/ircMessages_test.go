@@ -3,6 +3,7 @@ package twitchchat
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func Test_bytesToIrcMessage(t *testing.T) {
@@ -80,7 +81,12 @@ func Test_bytesToIrcMessage(t *testing.T) {
 		if msg.DisplayName != "ronni" {
 			t.Error("Wrong display name")
 		}
-		// @TODO more tags
+		if len(msg.EmoteSets) != 12 || msg.EmoteSets[11] != "12239" {
+			t.Error("Wrong emote sets")
+		}
+		if msg.Turbo || msg.UserType != UserTypeAdmin {
+			t.Error("Wrong user")
+		}
 	} else {
 		fmt.Printf("%T\n", msg)
 		t.Error("Join Message unsuccessfully parsed")
@@ -176,7 +182,7 @@ func Test_bytesToIrcMessage(t *testing.T) {
 		if len(msg.Servers) != 1 {
 			t.Error("Wrong server number")
 		}
-		if msg.Servers[0] != ":tmi.twitch.tv" {
+		if msg.Servers[0] != "tmi.twitch.tv" {
 			t.Error("Wrong server")
 		}
 	} else {
@@ -189,8 +195,21 @@ func Test_bytesToIrcMessage(t *testing.T) {
 	ircMsg = bytesToIrcMessage(bytes)
 	if msg, ok := ircMsg.(*PrivMsg); ok {
 
-		// @TODO parse/verify all tags
-
+		if msg.Color != (Color{R: 0x0D, G: 0x42, B: 0x00, Valid: true}) || msg.Color.String() != "#0D4200" {
+			t.Error("Wrong color")
+		}
+		if msg.Mod || msg.Subscriber || !msg.Turbo {
+			t.Error("Wrong flags")
+		}
+		if !msg.TmiSentTs.Equal(time.Unix(1507246572, 675*int64(time.Millisecond))) {
+			t.Error("Wrong timestamp")
+		}
+		if msg.UserType != UserTypeGlobalMod || msg.UserType.String() != "global_mod" {
+			t.Error("Wrong user type")
+		}
+		if msg.Bits != 0 {
+			t.Error("Wrong bits")
+		}
 		if msg.Channel != "dallas" {
 			t.Error("Wrong channel")
 		}
@@ -235,7 +254,7 @@ func Test_bytesToIrcMessage(t *testing.T) {
 	// "USERNOTICE":      USERNOTICE,
 	bytes = []byte("@badge-info=;badges=staff/1,broadcaster/1,turbo/1;color=#008000;display-name=ronni;emotes=;id=db25007f-7a18-43eb-9379-80131e44d633;login=ronni;mod=0;msg-id=resub;msg-param-cumulative-months=6;msg-param-streak-months=2;msg-param-should-share-streak=1;msg-param-sub-plan=Prime;msg-param-sub-plan-name=Prime;room-id=1337;subscriber=1;system-msg=ronni\\shas\\ssubscribed\\sfor\\s6\\smonths!;tmi-sent-ts=1507246572675;turbo=1;user-id=1337;user-type=staff :tmi.twitch.tv USERNOTICE #dallas :Great stream -- keep it up!")
 	ircMsg = bytesToIrcMessage(bytes)
-	if msg, ok := ircMsg.(*UserNotice); ok {
+	if msg, ok := ircMsg.(*Resub); ok {
 		if msg.Channel != "dallas" {
 			t.Error("Wrong channel")
 		}
@@ -248,12 +267,36 @@ func Test_bytesToIrcMessage(t *testing.T) {
 		if msg.DisplayName != "ronni" {
 			t.Error("Wrong Displayname")
 		}
+		if msg.SystemMsg != "ronni has subscribed for 6 months!" {
+			t.Error("Wrong system msg: " + msg.SystemMsg)
+		}
 		// @TODO Test rest of tags?
 	} else {
 		fmt.Printf("%T\n", msg)
 		t.Error("Usernotice Message unsuccessfully parsed")
 	}
 
+	// "WHISPER":         WHISPER,
+	bytes = []byte("@badges=;color=#8A2BE2;display-name=Bob;emotes=25:6-10;message-id=1;thread-id=1337_4242;turbo=0;user-id=4242;user-type= :bob!bob@bob.tmi.twitch.tv WHISPER ronni :hello Kappa")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*Whisper); ok {
+		if msg.Target != "ronni" || msg.Nickname != "bob" {
+			t.Error("Wrong users")
+		}
+		if msg.Message != "hello Kappa" {
+			t.Error("Wrong message")
+		}
+		if msg.ThreadId != "1337_4242" || msg.MessageId != "1" {
+			t.Error("Wrong ids")
+		}
+		if len(msg.Emotes) != 1 || msg.Emotes[0].Text != "Kappa" {
+			t.Error("Wrong emotes")
+		}
+	} else {
+		fmt.Printf("%T\n", msg)
+		t.Error("Whisper unsuccessfully parsed")
+	}
+
 	// "USERSTATE":       USERSTATE,
 	bytes = []byte("@badge-info=;badges=staff/1;color=#0D4200;display-name=ronni;emote-sets=0,33,50,237,793,2126,3517,4578,5569,9400,10337,12239;mod=1;subscriber=1;turbo=1;user-type=staff :tmi.twitch.tv USERSTATE #dallas")
 	ircMsg = bytesToIrcMessage(bytes)
@@ -273,3 +316,55 @@ func Test_bytesToIrcMessage(t *testing.T) {
 		t.Error("Usernotice Message unsuccessfully parsed")
 	}
 }
+
+func Test_bytesToIrcMessageTags(t *testing.T) {
+	bytes := []byte(`@empty=;novalue;escaped=a\sb\:c\\d\re\nf;unknown=\x;trailing=g\;equals=a=b :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa`)
+	msg, ok := bytesToIrcMessage(bytes).(*PrivMsg)
+	if !ok {
+		t.Fatal("PrivMsg unsuccessfully parsed")
+	}
+
+	expected := map[string]string{
+		"empty":    "",
+		"novalue":  "",
+		"escaped":  "a b;c\\d\re\nf",
+		"unknown":  "x",
+		"trailing": "g",
+		"equals":   "a=b",
+	}
+	for key, val := range expected {
+		if tag, ok := msg.RawTags[key]; !ok || tag != val {
+			t.Errorf("Wrong tag %s: %q", key, tag)
+		}
+	}
+}
+
+func Test_bytesToIrcMessageParams(t *testing.T) {
+	bytes := []byte(":ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa  Keepo :Kappa ")
+	if msg, ok := bytesToIrcMessage(bytes).(*PrivMsg); ok {
+		if msg.Message != "Kappa  Keepo :Kappa " {
+			t.Errorf("Wrong message: %q", msg.Message)
+		}
+		if len(msg.RawParams) != 2 {
+			t.Error("Wrong number of params: " + fmt.Sprint(len(msg.RawParams)))
+		}
+	} else {
+		t.Error("PrivMsg unsuccessfully parsed")
+	}
+
+	bytes = []byte(":tmi.twitch.tv   CAP  *  ACK :twitch.tv/tags twitch.tv/commands")
+	if msg, ok := bytesToIrcMessage(bytes).(*CapAck); ok {
+		if len(msg.RawParams) != 3 || string(msg.RawParams[2]) != "twitch.tv/tags twitch.tv/commands" {
+			t.Errorf("Wrong params: %q", msg.RawParams)
+		}
+	} else {
+		t.Error("CapAck unsuccessfully parsed")
+	}
+
+	// Malformed messages shouldn't panic
+	for _, line := range []string{"", " ", "@", "@a=b", ":", ":tmi.twitch.tv", "PRIVMSG", "PRIVMSG :", "CLEARCHAT", "HOSTTARGET #dallas :"} {
+		if bytesToIrcMessage([]byte(line)) == nil {
+			t.Errorf("No message for %q", line)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package twitchchat
+
+import "strings"
+
+// CapAck is sent when twitch grants the requested capabilities
+type CapAck struct {
+	RawIrcMessage
+	Capabilities []string
+}
+
+// CapNak is sent when twitch refuses the requested capabilities
+type CapNak struct {
+	RawIrcMessage
+	Capabilities []string
+}
+
+// Numeric replies. Twitch sends 001 to 004 and the MOTD once the login
+// succeeded. Nick is the user the reply was sent to
+
+// Welcome (001) is the first message sent after logging in successfully
+type Welcome struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// YourHost (002)
+type YourHost struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// Created (003)
+type Created struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// MyInfo (004)
+type MyInfo struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// NamesReply (353) lists users in a channel. Only sent with the
+// twitch.tv/membership capability
+type NamesReply struct {
+	RawIrcMessage
+	Nick    string
+	Channel string
+	Names   []string
+}
+
+// EndOfNames (366) follows the last NamesReply of a channel
+type EndOfNames struct {
+	RawIrcMessage
+	Nick    string
+	Channel string
+}
+
+// Motd (372) is a line of the message of the day
+type Motd struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// MotdStart (375)
+type MotdStart struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// EndOfMotd (376) is the last message sent after logging in
+type EndOfMotd struct {
+	RawIrcMessage
+	Nick    string
+	Message string
+}
+
+// UnknownCommand (421) is sent in response to a command twitch doesn't support
+type UnknownCommand struct {
+	RawIrcMessage
+	Nick     string
+	Rejected string // The command twitch doesn't support
+	Message  string
+}
+
+// :tmi.twitch.tv CAP * ACK :<capabilities>
+func newCapMsg(rawMsg RawIrcMessage) IrcMessage {
+	capabilities := strings.Fields(getParam(rawMsg.RawParams, 2))
+
+	switch getParam(rawMsg.RawParams, 1) {
+	case "ACK":
+		return &CapAck{
+			RawIrcMessage: rawMsg,
+			Capabilities:  capabilities,
+		}
+	case "NAK":
+		return &CapNak{
+			RawIrcMessage: rawMsg,
+			Capabilities:  capabilities,
+		}
+	}
+
+	return &rawMsg
+}
+
+// :tmi.twitch.tv <number> <nick> <params>
+func newReplyMsg(rawMsg RawIrcMessage) IrcMessage {
+	nick := getParam(rawMsg.RawParams, 0)
+	message := getParam(rawMsg.RawParams, 1)
+
+	switch rawMsg.RawCommand {
+	case RPL_WELCOME:
+		return &Welcome{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_YOURHOST:
+		return &YourHost{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_CREATED:
+		return &Created{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_MYINFO:
+		return &MyInfo{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_NAMREPLY:
+		// <nick> = #<channel> :<names>
+		return &NamesReply{
+			RawIrcMessage: rawMsg,
+			Nick:          nick,
+			Channel:       getChannelAt(rawMsg.RawParams, 2),
+			Names:         strings.Fields(getParam(rawMsg.RawParams, 3)),
+		}
+	case RPL_ENDOFNAMES:
+		// <nick> #<channel> :End of /NAMES list
+		return &EndOfNames{
+			RawIrcMessage: rawMsg,
+			Nick:          nick,
+			Channel:       getChannelAt(rawMsg.RawParams, 1),
+		}
+	case RPL_MOTD:
+		return &Motd{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_MOTDSTART:
+		return &MotdStart{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case RPL_ENDOFMOTD:
+		return &EndOfMotd{RawIrcMessage: rawMsg, Nick: nick, Message: message}
+	case ERR_UNKNOWNCOMMAND:
+		// <nick> <command> :Unknown command
+		return &UnknownCommand{
+			RawIrcMessage: rawMsg,
+			Nick:          nick,
+			Rejected:      message,
+			Message:       getParam(rawMsg.RawParams, 2),
+		}
+	}
+
+	return &rawMsg
+}
+
+// Like getChannel for replies that have the channel in params[i]
+func getChannelAt(params [][]byte, i int) string {
+	if len(params) > i {
+		return getChannel(params[i:])
+	}
+	return ""
+}
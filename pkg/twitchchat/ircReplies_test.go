@@ -0,0 +1,83 @@
+package twitchchat
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func Test_newReplyMsg(t *testing.T) {
+	var bytes []byte
+	var ircMsg IrcMessage
+
+	bytes = []byte(":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*CapAck); ok {
+		if !reflect.DeepEqual(msg.Capabilities, []string{"twitch.tv/tags", "twitch.tv/commands"}) {
+			t.Errorf("Wrong capabilities: %v", msg.Capabilities)
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("CapAck unsuccessfully parsed")
+	}
+
+	bytes = []byte(":tmi.twitch.tv CAP * NAK :twitch.tv/foo")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*CapNak); !ok || len(msg.Capabilities) != 1 || msg.Capabilities[0] != "twitch.tv/foo" {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("CapNak unsuccessfully parsed")
+	}
+
+	bytes = []byte(":tmi.twitch.tv 001 ronni :Welcome, GLHF!")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*Welcome); !ok || msg.Nick != "ronni" || msg.Message != "Welcome, GLHF!" {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("Welcome unsuccessfully parsed")
+	}
+
+	for line, expected := range map[string]string{
+		":tmi.twitch.tv 002 ronni :Your host is tmi.twitch.tv": "*twitchchat.YourHost",
+		":tmi.twitch.tv 003 ronni :This server is rather new":  "*twitchchat.Created",
+		":tmi.twitch.tv 004 ronni :-":                          "*twitchchat.MyInfo",
+		":tmi.twitch.tv 375 ronni :-":                          "*twitchchat.MotdStart",
+		":tmi.twitch.tv 372 ronni :You are in a maze":          "*twitchchat.Motd",
+		":tmi.twitch.tv 376 ronni :>":                          "*twitchchat.EndOfMotd",
+	} {
+		if parsed := fmt.Sprintf("%T", bytesToIrcMessage([]byte(line))); parsed != expected {
+			t.Error("Expected " + expected + " got " + parsed)
+		}
+	}
+
+	bytes = []byte(":ronni.tmi.twitch.tv 353 ronni = #dallas :ronni bob alice")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*NamesReply); ok {
+		if msg.Channel != "dallas" || msg.Nick != "ronni" {
+			t.Error("Wrong channel")
+		}
+		if !reflect.DeepEqual(msg.Names, []string{"ronni", "bob", "alice"}) {
+			t.Errorf("Wrong names: %v", msg.Names)
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("NamesReply unsuccessfully parsed")
+	}
+
+	bytes = []byte(":ronni.tmi.twitch.tv 366 ronni #dallas :End of /NAMES list")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*EndOfNames); !ok || msg.Channel != "dallas" {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("EndOfNames unsuccessfully parsed")
+	}
+
+	bytes = []byte(":tmi.twitch.tv 421 ronni WHO :Unknown command")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*UnknownCommand); !ok || msg.Rejected != "WHO" || msg.Command != "421" || msg.Message != "Unknown command" {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("UnknownCommand unsuccessfully parsed")
+	}
+
+	// Missing params shouldn't panic
+	for _, line := range []string{":tmi.twitch.tv 353", ":tmi.twitch.tv 366 ronni", ":tmi.twitch.tv CAP", "WHISPER"} {
+		bytesToIrcMessage([]byte(line))
+	}
+}
@@ -0,0 +1,63 @@
+package twitchchat
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Handler takes a message on to the callbacks registered for it
+type Handler func(msg IrcMessage)
+
+// Middleware wraps the Handler that dispatches messages to the callbacks. It
+// can inspect or annotate msg, pass a different message on to next, or drop
+// msg by not calling next at all
+type Middleware func(next Handler) Handler
+
+// Use adds middleware that every message goes through before being
+// dispatched. The middleware added first sees messages first. With
+// Options.DispatchWorkers it is called from several goroutines at once
+func (tc *TwitchChat) Use(mw ...Middleware) {
+	tc.messageRouter.use(mw...)
+}
+
+// Annotate stores value under key on the message, for middleware to pass
+// information on to callbacks
+func (msg *RawIrcMessage) Annotate(key string, value interface{}) {
+	if msg.Annotations == nil {
+		msg.Annotations = make(map[string]interface{})
+	}
+	msg.Annotations[key] = value
+}
+
+func (r *router) use(mw ...Middleware) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.middleware = append(r.middleware[:len(r.middleware):len(r.middleware)], mw...)
+
+	h := Handler(r.dispatch)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	r.handler = h
+}
+
+// handle passes msg through the middleware before dispatching it. Panics in
+// middleware are dispatched as CallbackError like those in callbacks
+func (r *router) handle(msg IrcMessage) {
+	r.mutex.RLock()
+	h := r.handler
+	r.mutex.RUnlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			r.fail(msg, fmt.Errorf("panic: %v", p), debug.Stack())
+		}
+	}()
+
+	if h == nil {
+		r.dispatch(msg)
+		return
+	}
+	h(msg)
+}
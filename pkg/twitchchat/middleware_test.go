@@ -0,0 +1,44 @@
+package twitchchat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tc := &TwitchChat{messageRouter: newRouter()}
+
+	var calls []string
+	On(tc, func(msg *PrivMsg) {
+		calls = append(calls, fmt.Sprint(msg.Message, " ", msg.Annotations["seen"]))
+	})
+	On(tc, func(msg *Join) {
+		calls = append(calls, "join")
+	})
+
+	tc.Use(func(next Handler) Handler {
+		return func(msg IrcMessage) {
+			calls = append(calls, "outer")
+			next(msg)
+		}
+	}, func(next Handler) Handler {
+		return func(msg IrcMessage) {
+			// Drop joins, annotate and rewrite messages
+			switch msg := msg.(type) {
+			case *Join:
+				return
+			case *PrivMsg:
+				msg.Annotate("seen", true)
+				next(&PrivMsg{RawIrcMessage: msg.RawIrcMessage, Message: "rewritten"})
+			default:
+				next(msg)
+			}
+		}
+	})
+
+	tc.messageRouter.handle(&Join{})
+	tc.messageRouter.handle(&PrivMsg{Message: "hi"})
+	if fmt.Sprint(calls) != "[outer outer rewritten true]" {
+		t.Error("Wrong calls: " + fmt.Sprint(calls))
+	}
+}
@@ -0,0 +1,197 @@
+package twitchchat
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit allows Count events Per duration. Events are spread out evenly
+// rather than sent in bursts, so the limit is never exceeded in any window
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (l RateLimit) limiter() *rate.Limiter {
+	if l.Count <= 0 || l.Per <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Every(l.Per/time.Duration(l.Count)), 1)
+}
+
+// RateProfile holds the limits twitch puts on an account. Exceeding them gets
+// the account locked out of chat for a while
+type RateProfile struct {
+	Chat    RateLimit // Across all channels
+	ModChat RateLimit // Across all channels, when a mod or broadcaster
+	Join    RateLimit
+	Auth    RateLimit // Logging in
+}
+
+var (
+	NormalProfile = RateProfile{
+		Chat:    RateLimit{20, 30 * time.Second},
+		ModChat: RateLimit{100, 30 * time.Second},
+		Join:    RateLimit{20, 10 * time.Second},
+		Auth:    RateLimit{20, 10 * time.Second},
+	}
+	VerifiedBotProfile = RateProfile{
+		Chat:    RateLimit{7500, 30 * time.Second},
+		ModChat: RateLimit{7500, 30 * time.Second},
+		Join:    RateLimit{2000, 10 * time.Second},
+		Auth:    RateLimit{200, 10 * time.Second},
+	}
+)
+
+// chatLimiter limits chat messages to the mod limit overall, and messages to
+// channels where we aren't elevated to the normal limit on top of that.
+// Channels are paused for the slow mode delay after every message, and when
+// twitch says we are sending too fast
+type chatLimiter struct {
+	global     *rate.Limiter
+	normal     *rate.Limiter
+	cooldown   time.Duration // How long to pause when rate limited
+	duplicates DuplicatePolicy
+	mutex      sync.RWMutex
+	elevated   map[string]bool // Mod or broadcaster
+	vip        map[string]bool
+	slow       map[string]time.Duration
+	paused     map[string]time.Time // "" for all channels
+	last       map[string]sentChat  // Last message sent per channel
+	// Channels where twitch accepts duplicate messages from us
+	duplicatesAllowed map[string]bool
+}
+
+func newChatLimiter(profile RateProfile) *chatLimiter {
+	return &chatLimiter{
+		global:   profile.ModChat.limiter(),
+		normal:   profile.Chat.limiter(),
+		cooldown: profile.Chat.Per,
+		elevated: make(map[string]bool),
+		vip:      make(map[string]bool),
+		slow:     make(map[string]time.Duration),
+		paused:   make(map[string]time.Time),
+		last:     make(map[string]sentChat),
+
+		duplicatesAllowed: make(map[string]bool),
+	}
+}
+
+func (l *chatLimiter) Limiters(event Event) []*rate.Limiter {
+	msg, _ := event.(chatMsg)
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.elevated[channelKey(msg.channel)] {
+		return []*rate.Limiter{l.global}
+	}
+	return []*rate.Limiter{l.global, l.normal}
+}
+
+func (l *chatLimiter) pausedUntil(event Event) time.Time {
+	msg, _ := event.(chatMsg)
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	until := l.paused[""]
+	if channel := l.paused[channelKey(msg.channel)]; channel.After(until) {
+		until = channel
+	}
+	if l.duplicates == DuplicateDelay {
+		if duplicate := l.duplicateUntil(msg); duplicate.After(until) {
+			until = duplicate
+		}
+	}
+	return until
+}
+
+func (l *chatLimiter) pause(channel string, d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pauseLocked(channel, d)
+}
+
+func (l *chatLimiter) pauseLocked(channel string, d time.Duration) {
+	until := time.Now().Add(d)
+	if until.After(l.paused[channel]) {
+		l.paused[channel] = until
+	}
+}
+
+// sent pauses channel for its slow mode delay and remembers message to tell
+// duplicates. Mods, VIPs and broadcasters aren't affected by slow mode
+func (l *chatLimiter) sent(channel, message string) {
+	channel = channelKey(channel)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sent := sentChat{message: message, at: time.Now()}
+	if last, ok := l.last[channel]; ok {
+		last.previous = nil
+		sent.previous = &last
+	}
+	l.last[channel] = sent
+	if slow := l.slow[channel]; slow > 0 && !l.elevated[channel] && !l.vip[channel] {
+		l.pauseLocked(channel, slow)
+	}
+}
+
+// observe keeps track of the channels we are a mod, broadcaster or VIP in and
+// their slow mode. Twitch sends a USERSTATE and ROOMSTATE on joining, a USERSTATE after
+// every message and a ROOMSTATE with only the changed tags when the room
+// settings change
+func (l *chatLimiter) observe(msg IrcMessage) {
+	switch msg := msg.(type) {
+	case *UserState:
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		setChannel(l.elevated, msg.Channel, msg.IsModerator() || msg.IsBroadcaster())
+		setChannel(l.vip, msg.Channel, msg.IsVIP())
+		setChannel(l.duplicatesAllowed, msg.Channel, duplicatesAllowed(msg))
+	case *RoomState:
+		if _, ok := msg.RawTags["slow"]; !ok {
+			return
+		}
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if msg.Slow > 0 {
+			l.slow[msg.Channel] = time.Duration(msg.Slow) * time.Second
+		} else {
+			delete(l.slow, msg.Channel)
+		}
+	case *Notice:
+		switch msg.MsgId {
+		case "msg_ratelimit":
+			l.pause("", l.cooldown)
+		case "msg_slowmode":
+			l.pause(msg.Channel, slowModeWait(msg))
+		}
+	}
+}
+
+func setChannel(channels map[string]bool, channel string, set bool) {
+	if set {
+		channels[channel] = true
+	} else {
+		delete(channels, channel)
+	}
+}
+
+var secondsPattern = regexp.MustCompile(`(\d+) seconds?`)
+
+// slowModeWait returns how long twitch said to wait before talking again,
+// such as "You will be able to talk again in 5 seconds."
+func slowModeWait(notice *Notice) time.Duration {
+	if match := secondsPattern.FindStringSubmatch(notice.Message); match != nil {
+		if seconds, err := strconv.Atoi(match[1]); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 30 * time.Second
+}
@@ -0,0 +1,86 @@
+package twitchchat
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimit(t *testing.T) {
+	if limit := NormalProfile.Chat.limiter().Limit(); limit != rate.Every(1500*time.Millisecond) {
+		t.Errorf("Wrong chat limit: %v", limit)
+	}
+	if limit := NormalProfile.Join.limiter().Limit(); limit != rate.Every(500*time.Millisecond) {
+		t.Errorf("Wrong join limit: %v", limit)
+	}
+	if limit := (RateLimit{}).limiter().Limit(); limit != rate.Inf {
+		t.Errorf("Wrong unset limit: %v", limit)
+	}
+}
+
+func TestChatLimiter(t *testing.T) {
+	l := newChatLimiter(NormalProfile)
+	msg := chatMsg{channel: "#Dallas"}
+
+	if len(l.Limiters(msg)) != 2 {
+		t.Error("Normal limit not applied")
+	}
+
+	l.observe(&UserState{Channel: "dallas", Mod: true})
+	l.observe(&UserState{Channel: "austin", Badges: []Badge{{Name: "vip", Version: "1"}}})
+	if limiters := l.Limiters(msg); len(limiters) != 1 || limiters[0] != l.global {
+		t.Error("Not elevated to mod limit")
+	}
+	if len(l.Limiters(chatMsg{channel: "austin"})) != 2 {
+		t.Error("Elevated to mod limit as VIP")
+	}
+
+	l.observe(&UserState{Channel: "dallas"})
+	if len(l.Limiters(msg)) != 2 {
+		t.Error("Still elevated after being unmodded")
+	}
+}
+
+func TestChatLimiterSlowMode(t *testing.T) {
+	l := newChatLimiter(NormalProfile)
+	msg := chatMsg{channel: "dallas"}
+
+	l.observe(&RoomState{RawIrcMessage: RawIrcMessage{RawTags: map[string]string{"slow": "10"}}, Channel: "dallas", Slow: 10})
+	l.sent("#Dallas", "hi")
+	if d := time.Until(l.pausedUntil(msg)); d < 9*time.Second || d > 10*time.Second {
+		t.Errorf("Wrong slow mode pause: %v", d)
+	}
+	l.observe(&RoomState{RawIrcMessage: RawIrcMessage{RawTags: map[string]string{"r9k": "1"}}, Channel: "dallas"})
+	if l.slow["dallas"] != 10*time.Second {
+		t.Error("Slow mode reset by other room setting")
+	}
+	l.observe(&UserState{Channel: "dallas", Mod: true})
+	l.paused = make(map[string]time.Time)
+	l.sent("dallas", "hi")
+	if !l.pausedUntil(msg).IsZero() {
+		t.Error("Slow mode applied to mod")
+	}
+	l.observe(&UserState{Channel: "dallas", Badges: []Badge{{Name: "vip", Version: "1"}}})
+	l.sent("dallas", "hi")
+	if !l.pausedUntil(msg).IsZero() {
+		t.Error("Slow mode applied to VIP")
+	}
+	l.observe(&RoomState{RawIrcMessage: RawIrcMessage{RawTags: map[string]string{"slow": "0"}}, Channel: "dallas"})
+	if len(l.slow) != 0 {
+		t.Error("Slow mode not turned off")
+	}
+
+	l.observe(&Notice{Channel: "dallas", MsgId: "msg_slowmode", Message: "You will be able to talk again in 5 seconds."})
+	if d := time.Until(l.pausedUntil(msg)); d < 4*time.Second || d > 5*time.Second {
+		t.Errorf("Wrong slow mode pause: %v", d)
+	}
+	if !l.pausedUntil(chatMsg{channel: "austin"}).IsZero() {
+		t.Error("Slow mode paused other channel")
+	}
+
+	l.observe(&Notice{Channel: "austin", MsgId: "msg_ratelimit"})
+	if d := time.Until(l.pausedUntil(chatMsg{channel: "austin"})); d < 29*time.Second {
+		t.Errorf("Wrong rate limit pause: %v", d)
+	}
+}
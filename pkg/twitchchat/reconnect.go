@@ -0,0 +1,174 @@
+package twitchchat
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Connected is dispatched once the connection to twitch has been established
+type Connected struct {
+	// True when the connection replaces one that was dropped
+	Reconnect bool
+}
+
+// Disconnected is dispatched when the connection to twitch is closed
+type Disconnected struct {
+	// Error that dropped the connection, nil when Disconnect was called
+	Err error
+}
+
+// Reconnecting is dispatched before every attempt to reconnect
+type Reconnecting struct {
+	Attempt int
+	Delay   time.Duration
+}
+
+// ReconnectFailed is dispatched when MaxReconnectAttempts has been reached.
+// No more attempts to reconnect will be made
+type ReconnectFailed struct {
+	Attempts int
+	Err      error
+}
+
+func (*Connected) ircMessage()       {}
+func (*Disconnected) ircMessage()    {}
+func (*Reconnecting) ircMessage()    {}
+func (*ReconnectFailed) ircMessage() {}
+
+// backoff hands out exponentially growing delays with jitter. Half of the
+// delay is fixed and the other half random so that many clients dropped at
+// the same time don't all come back at the same time
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.min << uint(b.attempt); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// superviseConnection passes messages from c on to ircChan and reconnects
+// whenever the connection drops, until Disconnect is called. ircChan is
+// closed once no more messages will be sent on it
+func (tc *TwitchChat) superviseConnection(c *conn, ircChan chan IrcMessage, stop chan struct{}) {
+	defer close(ircChan)
+
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	ircChan <- &Connected{}
+
+	b := backoff{
+		min: tc.options.MinReconnectDelay,
+		max: tc.options.MaxReconnectDelay,
+	}
+	for {
+		connectedAt := time.Now()
+		c = tc.forward(c, ircChan, stop)
+
+		if isClosed(stop) {
+			ircChan <- &Disconnected{}
+			return
+		}
+		err := c.irc.Err()
+		ircChan <- &Disconnected{Err: err}
+
+		if tc.options.DisableReconnect {
+			return
+		}
+
+		// Only start backing off from scratch if the last connection was stable
+		if time.Since(connectedAt) > b.max {
+			b.reset()
+		}
+
+		for {
+			if tc.options.MaxReconnectAttempts > 0 && b.attempt >= tc.options.MaxReconnectAttempts {
+				ircChan <- &ReconnectFailed{
+					Attempts: b.attempt,
+					Err:      err,
+				}
+				return
+			}
+
+			delay := b.next()
+			ircChan <- &Reconnecting{
+				Attempt: b.attempt,
+				Delay:   delay,
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				ircChan <- &Disconnected{}
+				return
+			}
+
+			var next *conn
+			if next, err = tc.dial(ctx); err == nil {
+				c = next
+				break
+			}
+		}
+
+		tc.connMutex.Lock()
+		if isClosed(stop) {
+			// Disconnect was called while connecting. Drop the new
+			// connection and let the next loop clean up
+			tc.connMutex.Unlock()
+			c.irc.Disconnect()
+			continue
+		}
+		tc.irc = c.irc
+		tc.connMutex.Unlock()
+
+		tc.rejoinChannels()
+		ircChan <- &Connected{Reconnect: true}
+	}
+}
+
+func (tc *TwitchChat) rejoinChannels() {
+	tc.joinChannelMutex.RLock()
+	defer tc.joinChannelMutex.RUnlock()
+
+	for channel := range tc.joinedChannels {
+		tc.joinBucket.AddEvent(joinMsg{channel: channel}, false)
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopContext returns a context that is cancelled once stop is closed
+func stopContext(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,34 @@
+package twitchchat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{
+		min: time.Second,
+		max: 30 * time.Second,
+	}
+
+	expected := []time.Duration{1, 2, 4, 8, 16, 30, 30}
+	for i, max := range expected {
+		max *= time.Second
+		delay := b.next()
+		if delay < max/2 || delay > max {
+			t.Error("Attempt " + fmt.Sprint(i+1) + " delay " + delay.String() + " not within " + (max / 2).String() + "-" + max.String())
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if delay := b.next(); delay > b.max {
+			t.Error("Delay " + delay.String() + " larger than max")
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay > b.min {
+		t.Error("Delay " + delay.String() + " not reset")
+	}
+}
@@ -0,0 +1,255 @@
+package twitchchat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for twitch to confirm a chat message or join once it has
+// been written
+const confirmTimeout = 10 * time.Second
+
+// ErrNoConfirmation is the error of a SendResult that twitch neither
+// confirmed nor rejected. The message may still have been delivered
+var ErrNoConfirmation = errors.New("no confirmation received from twitch")
+
+// SendResult resolves once a chat message or join has been confirmed or
+// rejected by twitch, or couldn't be sent at all
+type SendResult struct {
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+func newSendResult() *SendResult {
+	return &SendResult{
+		done: make(chan struct{}),
+	}
+}
+
+func (r *SendResult) resolve(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+	})
+}
+
+// Done is closed once the result is known
+func (r *SendResult) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns why sending failed, nil on success or while still pending
+func (r *SendResult) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the result is known or ctx is done
+func (r *SendResult) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RejectedError is the error of a SendResult that twitch rejected with a
+// NOTICE, such as msg_duplicate or msg_ratelimit
+type RejectedError struct {
+	Notice *Notice
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by twitch: " + e.Notice.MsgId + ": " + e.Notice.Message
+}
+
+// Retryable reports whether sending the same again later could succeed
+func (e *RejectedError) Retryable() bool {
+	switch e.Notice.MsgId {
+	case "msg_ratelimit", "msg_slowmode", "msg_duplicate":
+		return true
+	}
+	return false
+}
+
+// NOTICE msg-ids twitch rejects joins with, all other msg_ ones are about
+// chat messages
+var joinRejections = map[string]bool{
+	"msg_channel_suspended": true,
+	"tos_ban":               true,
+}
+
+type pending struct {
+	result *SendResult
+	event  Event
+	timer  *time.Timer
+}
+
+// confirmations matches the USERSTATE, JOIN and NOTICE messages twitch
+// answers with to the chat messages and joins waiting for them. Twitch
+// answers in order, so the oldest one waiting in a channel is resolved
+type confirmations struct {
+	nick  string
+	mutex sync.Mutex
+	chats map[string][]*pending
+	joins map[string][]*pending
+	// Channels between our JOIN and the ROOMSTATE that ends joining. The
+	// USERSTATE sent in between isn't about a chat message
+	joining map[string]bool
+	// Called with chat messages twitch rejected. Reports whether the
+	// message was queued again
+	rejected func(event Event, notice *Notice) bool
+}
+
+func newConfirmations(nick string) *confirmations {
+	return &confirmations{
+		nick:    nick,
+		chats:   make(map[string][]*pending),
+		joins:   make(map[string][]*pending),
+		joining: make(map[string]bool),
+	}
+}
+
+// expect has to be called before writing, the answer may arrive before the
+// write returns
+func (c *confirmations) expect(waiting map[string][]*pending, channel string, result *SendResult, event Event) *pending {
+	p := &pending{result: result, event: event}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	waiting[channel] = append(waiting[channel], p)
+	p.timer = time.AfterFunc(confirmTimeout, func() {
+		c.remove(waiting, channel, p, ErrNoConfirmation)
+	})
+	return p
+}
+
+func (c *confirmations) expectChat(msg chatMsg) func(err error) {
+	channel := channelKey(msg.channel)
+	p := c.expect(c.chats, channel, msg.result, msg)
+	return func(err error) {
+		c.remove(c.chats, channel, p, err)
+	}
+}
+
+func (c *confirmations) expectJoin(channel string, result *SendResult) func(err error) {
+	channel = channelKey(channel)
+	p := c.expect(c.joins, channel, result, nil)
+	return func(err error) {
+		c.remove(c.joins, channel, p, err)
+	}
+}
+
+// channelKey returns channel the way twitch sends it
+func channelKey(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(channel, "#"))
+}
+
+// remove resolves p if it is still waiting
+func (c *confirmations) remove(waiting map[string][]*pending, channel string, p *pending, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	list := waiting[channel]
+	for i := range list {
+		if list[i] == p {
+			waiting[channel] = append(list[:i:i], list[i+1:]...)
+			if len(waiting[channel]) == 0 {
+				delete(waiting, channel)
+			}
+			p.timer.Stop()
+			p.result.resolve(err)
+			return
+		}
+	}
+}
+
+// takeOldest removes the oldest one waiting in channel, nil if there is none
+func (c *confirmations) takeOldest(waiting map[string][]*pending, channel string) *pending {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	list := waiting[channel]
+	if len(list) == 0 {
+		return nil
+	}
+	if len(list) == 1 {
+		delete(waiting, channel)
+	} else {
+		waiting[channel] = list[1:]
+	}
+	list[0].timer.Stop()
+	return list[0]
+}
+
+// resolveOldest reports whether anything was waiting in channel
+func (c *confirmations) resolveOldest(waiting map[string][]*pending, channel string, err error) bool {
+	p := c.takeOldest(waiting, channel)
+	if p == nil {
+		return false
+	}
+	p.result.resolve(err)
+	return true
+}
+
+func (c *confirmations) observe(msg IrcMessage) {
+	switch msg := msg.(type) {
+	case *UserState:
+		c.mutex.Lock()
+		joining := c.joining[msg.Channel]
+		c.mutex.Unlock()
+		if !joining {
+			c.resolveOldest(c.chats, msg.Channel, nil)
+		}
+	case *RoomState:
+		c.mutex.Lock()
+		delete(c.joining, msg.Channel)
+		c.mutex.Unlock()
+	case *Join:
+		if strings.EqualFold(msg.Nickname, c.nick) {
+			c.mutex.Lock()
+			c.joining[msg.Channel] = true
+			c.mutex.Unlock()
+			c.resolveOldest(c.joins, msg.Channel, nil)
+		}
+	case *Notice:
+		err := &RejectedError{Notice: msg}
+		if joinRejections[msg.MsgId] && c.resolveOldest(c.joins, msg.Channel, err) {
+			return
+		}
+		if !strings.HasPrefix(msg.MsgId, "msg_") {
+			return
+		}
+		if p := c.takeOldest(c.chats, msg.Channel); p != nil {
+			if c.rejected == nil || !c.rejected(p.event, msg) {
+				p.result.resolve(err)
+			}
+		}
+	}
+}
+
+// clear resolves everything still waiting with err
+func (c *confirmations) clear(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, waiting := range []map[string][]*pending{c.chats, c.joins} {
+		for channel, list := range waiting {
+			for _, p := range list {
+				p.timer.Stop()
+				p.result.resolve(err)
+			}
+			delete(waiting, channel)
+		}
+	}
+	c.joining = make(map[string]bool)
+}
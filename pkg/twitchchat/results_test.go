@@ -0,0 +1,73 @@
+package twitchchat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConfirmations(t *testing.T) {
+	c := newConfirmations("ronni")
+
+	first, second, third := newSendResult(), newSendResult(), newSendResult()
+	c.expectChat(chatMsg{channel: "#Dallas", result: first})
+	c.expectChat(chatMsg{channel: "dallas", result: second})
+	failed := c.expectChat(chatMsg{channel: "dallas", result: third})
+
+	c.observe(&UserState{Channel: "austin"})
+	if first.Err() != nil || isClosed(first.done) {
+		t.Error("Resolved by another channel")
+	}
+
+	c.observe(&UserState{Channel: "dallas"})
+	if !isClosed(first.done) || first.Err() != nil {
+		t.Error("Not confirmed")
+	}
+
+	c.observe(&Notice{Channel: "dallas", MsgId: "msg_duplicate", Message: "Your message is identical"})
+	var rejected *RejectedError
+	if !errors.As(second.Err(), &rejected) || !rejected.Retryable() {
+		t.Error("Wrong rejection: " + second.Err().Error())
+	}
+
+	writeErr := errors.New("write failed")
+	failed(writeErr)
+	if third.Err() != writeErr {
+		t.Error("Write error not reported")
+	}
+
+	join, suspended := newSendResult(), newSendResult()
+	c.expectJoin("dallas", join)
+	c.expectJoin("austin", suspended)
+	c.observe(&Join{RawIrcMessage: RawIrcMessage{ircPrefix: ircPrefix{Nickname: "bob"}}, Channel: "dallas"})
+	if isClosed(join.done) {
+		t.Error("Resolved by someone else joining")
+	}
+	c.observe(&Join{RawIrcMessage: RawIrcMessage{ircPrefix: ircPrefix{Nickname: "ronni"}}, Channel: "dallas"})
+	if !isClosed(join.done) || join.Err() != nil {
+		t.Error("Join not confirmed")
+	}
+	c.observe(&Notice{Channel: "austin", MsgId: "msg_channel_suspended"})
+	if !errors.As(suspended.Err(), &rejected) || rejected.Retryable() {
+		t.Error("Join not rejected")
+	}
+
+	// The USERSTATE sent on joining doesn't confirm a chat message
+	chat := newSendResult()
+	c.expectChat(chatMsg{channel: "dallas", result: chat})
+	c.observe(&UserState{Channel: "dallas"})
+	if isClosed(chat.done) {
+		t.Error("Confirmed by USERSTATE sent on joining")
+	}
+	c.observe(&RoomState{Channel: "dallas"})
+	c.observe(&UserState{Channel: "dallas"})
+	if !isClosed(chat.done) {
+		t.Error("Not confirmed after joining")
+	}
+
+	pending := newSendResult()
+	c.expectChat(chatMsg{channel: "dallas", result: pending})
+	c.clear(ErrNoConfirmation)
+	if pending.Err() != ErrNoConfirmation || len(c.chats) != 0 || len(c.joins) != 0 {
+		t.Error("Not cleared")
+	}
+}
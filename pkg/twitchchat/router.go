@@ -0,0 +1,225 @@
+package twitchchat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// router passes messages on to the callbacks registered for their type
+type router struct {
+	mutex      sync.RWMutex
+	handlers   map[reflect.Type][]*handler
+	middleware []Middleware
+	handler    Handler // middleware wrapped around dispatch
+}
+
+type handler struct {
+	call         func(msg IrcMessage) error
+	unsubscribed int32
+}
+
+// CallbackError is dispatched when a callback panics or returns an error.
+// Without a callback registered for it, it is logged
+type CallbackError struct {
+	Message IrcMessage // Being handled when the callback failed
+	Err     error
+	Stack   []byte // Set when the callback panicked
+}
+
+func (e *CallbackError) ircMessage() {}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("callback for %T failed: %v", e.Message, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+// Subscription is returned when registering a callback
+type Subscription struct {
+	router *router
+	key    reflect.Type
+	h      *handler
+}
+
+func newRouter() *router {
+	return &router{
+		handlers: make(map[reflect.Type][]*handler),
+	}
+}
+
+// Message is implemented by the types of message that are dispatched, such
+// as *PrivMsg and *Connected, so On rejects callbacks for other types such as
+// string or PrivMsg. Types outside the package that embed RawIrcMessage
+// implement it too, but are never dispatched
+type Message interface {
+	IrcMessage
+	ircMessage()
+}
+
+// On registers cb for messages of type T, e.g.
+//
+//	twitchchat.On(tc, func(msg *twitchchat.PrivMsg) { ... })
+//
+// Callbacks are called in the order they were registered. Can be called
+// while connected
+func On[T Message](tc *TwitchChat, cb func(msg T)) *Subscription {
+	return tc.messageRouter.add(reflect.TypeOf((*T)(nil)).Elem(), func(msg IrcMessage) error {
+		cb(msg.(T))
+		return nil
+	})
+}
+
+// OnErr is like On, the errors returned by cb are dispatched as
+// *CallbackError
+func OnErr[T Message](tc *TwitchChat, cb func(msg T) error) *Subscription {
+	return tc.messageRouter.add(reflect.TypeOf((*T)(nil)).Elem(), func(msg IrcMessage) error {
+		return cb(msg.(T))
+	})
+}
+
+// register adds a callback of unknown type, which has to take a single
+// pointer and return nothing or an error. Calling it goes through
+// reflection, unlike callbacks added by On
+func (r *router) register(cb interface{}) (*Subscription, error) {
+	v := reflect.ValueOf(cb)
+	if v.Kind() != reflect.Func {
+		return nil, errors.New("not a function")
+	}
+
+	if v.Type().NumIn() != 1 {
+		return nil, errors.New("too many args")
+	}
+
+	ti := v.Type().In(0)
+	if ti.Kind() != reflect.Ptr {
+		return nil, errors.New("wrong type of arg")
+	}
+
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	switch {
+	case v.Type().NumOut() == 0:
+	case v.Type().NumOut() == 1 && v.Type().Out(0) == errorType:
+	default:
+		return nil, errors.New("wrong return type")
+	}
+
+	return r.add(ti, func(msg IrcMessage) error {
+		out := v.Call([]reflect.Value{reflect.ValueOf(msg)})
+		if len(out) == 0 || out[0].IsNil() {
+			return nil
+		}
+		return out[0].Interface().(error)
+	}), nil
+}
+
+func (r *router) add(key reflect.Type, call func(msg IrcMessage) error) *Subscription {
+	sub := &Subscription{
+		router: r,
+		key:    key,
+		h:      &handler{call: call},
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Handlers are replaced rather than appended to in place so that
+	// dispatch can go through them without holding the lock
+	handlers := r.handlers[sub.key]
+	r.handlers[sub.key] = append(handlers[:len(handlers):len(handlers)], sub.h)
+
+	return sub
+}
+
+// Unsubscribe removes the callback. A call that is already in progress
+// finishes, but the callback isn't called again once Unsubscribe returns
+func (sub *Subscription) Unsubscribe() {
+	if !atomic.CompareAndSwapInt32(&sub.h.unsubscribed, 0, 1) {
+		return
+	}
+
+	r := sub.router
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	handlers := r.handlers[sub.key]
+	remaining := make([]*handler, 0, len(handlers))
+	for _, h := range handlers {
+		if h != sub.h {
+			remaining = append(remaining, h)
+		}
+	}
+	if len(remaining) > 0 {
+		r.handlers[sub.key] = remaining
+	} else {
+		delete(r.handlers, sub.key)
+	}
+}
+
+// reflect.TypeOf only reads the type of msg, the callbacks are called
+// directly
+func (r *router) lookup(msg IrcMessage) []*handler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.handlers[reflect.TypeOf(msg)]
+}
+
+func (r *router) dispatch(msg IrcMessage) {
+	handlers := r.lookup(msg)
+	typed := msg
+	if notice, ok := msg.(userNoticeEvent); ok && len(handlers) == 0 {
+		// Fall back to the callbacks for a plain UserNotice
+		typed = notice.userNotice()
+		handlers = r.lookup(typed)
+	}
+
+	for _, h := range handlers {
+		if atomic.LoadInt32(&h.unsubscribed) == 0 {
+			r.call(h, typed)
+		}
+	}
+
+	// Handlers added without a type get every message
+	r.mutex.RLock()
+	handlers = r.handlers[nil]
+	r.mutex.RUnlock()
+	for _, h := range handlers {
+		if atomic.LoadInt32(&h.unsubscribed) == 0 {
+			r.call(h, msg)
+		}
+	}
+}
+
+// call runs a single callback, so that a panic doesn't stop the other
+// callbacks or the dispatching goroutine
+func (r *router) call(h *handler, msg IrcMessage) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.fail(msg, fmt.Errorf("panic: %v", p), debug.Stack())
+		}
+	}()
+
+	if err := h.call(msg); err != nil {
+		r.fail(msg, err, nil)
+	}
+}
+
+func (r *router) fail(msg IrcMessage, err error, stack []byte) {
+	cbErr := &CallbackError{Message: msg, Err: err, Stack: stack}
+
+	// Failing callbacks for CallbackError are only logged, so they can't loop
+	if _, ok := msg.(*CallbackError); ok || len(r.lookup(cbErr)) == 0 {
+		log.Println(cbErr)
+		if stack != nil {
+			log.Println(string(stack))
+		}
+		return
+	}
+	r.dispatch(cbErr)
+}
@@ -0,0 +1,176 @@
+package twitchchat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	r := newRouter()
+
+	var calls []string
+	first, err := r.register(func(msg *PrivMsg) {
+		calls = append(calls, "first")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.register(func(msg *PrivMsg) {
+		calls = append(calls, "second")
+	})
+	r.register(func(msg *Join) {
+		calls = append(calls, "join")
+	})
+
+	r.dispatch(&PrivMsg{})
+	if fmt.Sprint(calls) != "[first second]" {
+		t.Error("Wrong calls: " + fmt.Sprint(calls))
+	}
+
+	calls = nil
+	first.Unsubscribe()
+	first.Unsubscribe()
+	r.dispatch(&PrivMsg{})
+	r.dispatch(&Join{})
+	if fmt.Sprint(calls) != "[second join]" {
+		t.Error("Wrong calls after unsubscribe: " + fmt.Sprint(calls))
+	}
+
+	for _, cb := range []interface{}{"not a func", func() {}, func(msg PrivMsg) {}, func(a, b *PrivMsg) {}, func(msg *PrivMsg) string { return "" }} {
+		if _, err := r.register(cb); err == nil {
+			t.Errorf("No error registering %T", cb)
+		}
+	}
+}
+
+func TestRouterConcurrent(t *testing.T) {
+	r := newRouter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub, _ := r.register(func(msg *PrivMsg) {})
+				sub.Unsubscribe()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.dispatch(&PrivMsg{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(r.handlers) != 0 {
+		t.Error("Handlers left after unsubscribing")
+	}
+}
+
+func TestOn(t *testing.T) {
+	tc := &TwitchChat{messageRouter: newRouter()}
+
+	var calls []string
+	sub := On(tc, func(msg *PrivMsg) {
+		calls = append(calls, "priv "+msg.Message)
+	})
+	On(tc, func(msg *UserNotice) {
+		calls = append(calls, "notice "+msg.MsgId)
+	})
+	tc.RegisterCallback(func(msg *PrivMsg) {
+		calls = append(calls, "legacy "+msg.Message)
+	})
+
+	tc.messageRouter.dispatch(&PrivMsg{Message: "hi"})
+	tc.messageRouter.dispatch(&Raid{UserNotice: UserNotice{MsgId: "raid"}})
+	if fmt.Sprint(calls) != "[priv hi legacy hi notice raid]" {
+		t.Error("Wrong calls: " + fmt.Sprint(calls))
+	}
+
+	calls = nil
+	sub.Unsubscribe()
+	tc.messageRouter.dispatch(&PrivMsg{Message: "hi"})
+	if fmt.Sprint(calls) != "[legacy hi]" {
+		t.Error("Wrong calls after unsubscribe: " + fmt.Sprint(calls))
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msgs := []IrcMessage{&Connected{}, &Disconnected{}, &Reconnecting{}, &ReconnectFailed{}, &CallbackError{}}
+	for _, line := range []string{
+		"PING :tmi.twitch.tv",
+		":tmi.twitch.tv 421 ronni WHO :Unknown command",
+		"@msg-id=resub :tmi.twitch.tv USERNOTICE #dallas :Great stream",
+		":ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :hi",
+		":tmi.twitch.tv FOO",
+	} {
+		msgs = append(msgs, bytesToIrcMessage([]byte(line)))
+	}
+
+	for _, msg := range msgs {
+		if _, ok := msg.(Message); !ok {
+			t.Errorf("%T can't be registered with On", msg)
+		}
+	}
+}
+
+func TestCallbackError(t *testing.T) {
+	tc := &TwitchChat{messageRouter: newRouter()}
+
+	var calls []string
+	On(tc, func(msg *PrivMsg) {
+		panic("oops")
+	})
+	OnErr(tc, func(msg *PrivMsg) error {
+		return errors.New("failed")
+	})
+	tc.RegisterCallback(func(msg *PrivMsg) error {
+		return errors.New("legacy failed")
+	})
+	On(tc, func(msg *PrivMsg) {
+		calls = append(calls, "called")
+	})
+
+	var errs []*CallbackError
+	On(tc, func(msg *CallbackError) {
+		errs = append(errs, msg)
+		panic("not dispatched again")
+	})
+
+	tc.messageRouter.handle(&PrivMsg{})
+	if fmt.Sprint(calls) != "[called]" {
+		t.Error("Wrong calls: " + fmt.Sprint(calls))
+	}
+	if len(errs) != 3 {
+		t.Fatal("Wrong number of errors: " + fmt.Sprint(len(errs)))
+	}
+	if errs[0].Err.Error() != "panic: oops" || !strings.Contains(string(errs[0].Stack), "TestCallbackError") {
+		t.Error("Wrong panic error: " + errs[0].Error())
+	}
+	if _, ok := errs[0].Message.(*PrivMsg); !ok {
+		t.Errorf("Wrong message: %T", errs[0].Message)
+	}
+	if errs[1].Err.Error() != "failed" || errs[1].Stack != nil {
+		t.Error("Wrong returned error: " + errs[1].Error())
+	}
+	if errs[2].Err.Error() != "legacy failed" {
+		t.Error("Wrong legacy error: " + errs[2].Error())
+	}
+
+	errs = nil
+	tc.Use(func(next Handler) Handler {
+		return func(msg IrcMessage) {
+			panic("middleware")
+		}
+	})
+	tc.messageRouter.handle(&PrivMsg{})
+	if len(errs) != 1 || errs[0].Err.Error() != "panic: middleware" {
+		t.Error("Middleware panic not reported")
+	}
+}
@@ -0,0 +1,174 @@
+package twitchchat
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Filter selects the messages sent to a channel returned by Subscribe. Empty
+// fields match every message
+type Filter struct {
+	// Types of message to receive, such as (*PrivMsg)(nil). *UserNotice also
+	// matches the subtypes such as *Sub and *Raid
+	Types   []IrcMessage
+	Channel string // Without the leading #
+	User    string // Login of the sender
+
+	BufferSize int // Defaults to 64
+	// What to do when the buffer is full because messages aren't received
+	// fast enough. OverflowBlock holds up all other callbacks until there is
+	// room in the buffer
+	Overflow OverflowPolicy
+	// Called with every message dropped because the buffer was full. Called
+	// while dispatching, so it holds up the other callbacks
+	OnDrop func(msg IrcMessage)
+}
+
+func (f *Filter) match(msg IrcMessage) bool {
+	if len(f.Types) > 0 {
+		matched := false
+		for _, t := range f.Types {
+			if reflect.TypeOf(t) == reflect.TypeOf(msg) {
+				matched = true
+				break
+			}
+			if _, ok := t.(*UserNotice); ok {
+				if _, ok := msg.(userNoticeEvent); ok {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if f.Channel != "" && !strings.EqualFold(strings.TrimPrefix(f.Channel, "#"), messageChannel(msg)) {
+		return false
+	}
+
+	if f.User != "" {
+		raw, ok := msg.(interface{ Raw() *RawIrcMessage })
+		if !ok || !strings.EqualFold(f.User, raw.Raw().Nickname) {
+			return false
+		}
+	}
+	return true
+}
+
+type subscriber struct {
+	filter Filter
+	ch     chan IrcMessage
+	done   chan struct{}
+	mutex  sync.RWMutex // Held for writing when closing ch
+	sub    *Subscription
+}
+
+func (s *subscriber) send(msg IrcMessage) {
+	if !s.filter.match(msg) {
+		return
+	}
+
+	// Reported once unlocked, OnDrop may unsubscribe
+	for _, dropped := range s.queue(msg) {
+		if s.filter.OnDrop != nil {
+			s.filter.OnDrop(dropped)
+		}
+	}
+}
+
+// queue puts msg in the buffer and returns the messages dropped to make room
+func (s *subscriber) queue(msg IrcMessage) (dropped []IrcMessage) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if isClosed(s.done) {
+		return nil
+	}
+
+	switch s.filter.Overflow {
+	case OverflowDropNewest, OverflowReject:
+		select {
+		case s.ch <- msg:
+		default:
+			dropped = append(dropped, msg)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				return dropped
+			default:
+			}
+			select {
+			case old := <-s.ch:
+				dropped = append(dropped, old)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+		}
+	}
+	return dropped
+}
+
+func (s *subscriber) close() {
+	s.sub.Unsubscribe()
+
+	// Closing done first lets a blocked send return so the lock can be taken
+	close(s.done)
+	s.mutex.Lock()
+	close(s.ch)
+	s.mutex.Unlock()
+}
+
+// Subscribe returns a channel receiving the messages that match filter. It
+// is closed once the connection is closed for good, after Disconnect or when
+// reconnecting failed, or by calling Unsubscribe
+func (tc *TwitchChat) Subscribe(filter Filter) <-chan IrcMessage {
+	if filter.BufferSize <= 0 {
+		filter.BufferSize = 64
+	}
+
+	s := &subscriber{
+		filter: filter,
+		ch:     make(chan IrcMessage, filter.BufferSize),
+		done:   make(chan struct{}),
+	}
+	s.sub = tc.messageRouter.add(nil, func(msg IrcMessage) error {
+		s.send(msg)
+		return nil
+	})
+
+	tc.subscriberMutex.Lock()
+	tc.subscribers[s.ch] = s
+	tc.subscriberMutex.Unlock()
+	return s.ch
+}
+
+// Unsubscribe closes a channel returned by Subscribe
+func (tc *TwitchChat) Unsubscribe(ch <-chan IrcMessage) {
+	tc.subscriberMutex.Lock()
+	s, ok := tc.subscribers[ch]
+	delete(tc.subscribers, ch)
+	tc.subscriberMutex.Unlock()
+
+	if ok {
+		s.close()
+	}
+}
+
+func (tc *TwitchChat) closeSubscribers() {
+	tc.subscriberMutex.Lock()
+	subscribers := tc.subscribers
+	tc.subscribers = make(map[<-chan IrcMessage]*subscriber)
+	tc.subscriberMutex.Unlock()
+
+	for _, s := range subscribers {
+		s.close()
+	}
+}
@@ -0,0 +1,90 @@
+package twitchchat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	priv := privMsgTo("dallas", "hi")
+	priv.Nickname = "bob"
+	raid := &Raid{}
+
+	for i, test := range []struct {
+		filter   Filter
+		msg      IrcMessage
+		expected bool
+	}{
+		{Filter{}, priv, true},
+		{Filter{}, &Connected{}, true},
+		{Filter{Types: []IrcMessage{(*Join)(nil), (*PrivMsg)(nil)}}, priv, true},
+		{Filter{Types: []IrcMessage{(*Join)(nil)}}, priv, false},
+		{Filter{Types: []IrcMessage{(*UserNotice)(nil)}}, raid, true},
+		{Filter{Types: []IrcMessage{(*Sub)(nil)}}, raid, false},
+		{Filter{Channel: "#Dallas"}, priv, true},
+		{Filter{Channel: "austin"}, priv, false},
+		{Filter{Channel: "dallas"}, &Connected{}, false},
+		{Filter{User: "Bob"}, priv, true},
+		{Filter{User: "alice"}, priv, false},
+	} {
+		if test.filter.match(test.msg) != test.expected {
+			t.Errorf("Wrong match for filter %d", i)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tc := &TwitchChat{
+		messageRouter: newRouter(),
+		subscribers:   make(map[<-chan IrcMessage]*subscriber),
+	}
+
+	all := tc.Subscribe(Filter{})
+	var lost []string
+	dropped := tc.Subscribe(Filter{
+		Types:      []IrcMessage{(*PrivMsg)(nil)},
+		BufferSize: 2,
+		Overflow:   OverflowDropOldest,
+		OnDrop: func(msg IrcMessage) {
+			lost = append(lost, msg.(*PrivMsg).Message)
+		},
+	})
+	blocked := tc.Subscribe(Filter{BufferSize: 1})
+
+	tc.messageRouter.dispatch(privMsgTo("dallas", "0"))
+	done := make(chan struct{})
+	go func() {
+		// Blocks until blocked is unsubscribed
+		tc.messageRouter.dispatch(privMsgTo("dallas", "1"))
+		tc.messageRouter.dispatch(privMsgTo("dallas", "2"))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tc.Unsubscribe(blocked)
+	<-done
+	tc.messageRouter.dispatch(&Connected{})
+
+	if msg := <-dropped; msg.(*PrivMsg).Message != "1" {
+		t.Error("Oldest message not dropped")
+	}
+	if fmt.Sprint(lost) != "[0]" {
+		t.Error("Wrong dropped messages: " + fmt.Sprint(lost))
+	}
+	if len(all) != 4 {
+		t.Error("Wrong number of messages: " + fmt.Sprint(len(all)))
+	}
+	if _, ok := <-blocked; !ok {
+		t.Error("Buffered message lost")
+	}
+	if _, ok := <-blocked; ok {
+		t.Error("Channel not closed on unsubscribe")
+	}
+
+	tc.closeSubscribers()
+	for range all {
+	}
+	if len(tc.messageRouter.handlers) != 0 {
+		t.Error("Handlers left after closing")
+	}
+}
@@ -0,0 +1,96 @@
+package twitchchat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Color of a user's name in chat. Valid is false if the user never set one
+type Color struct {
+	R     uint8
+	G     uint8
+	B     uint8
+	Valid bool
+}
+
+// String returns the color as #RRGGBB, or an empty string if not valid
+func (c Color) String() string {
+	if !c.Valid {
+		return ""
+	}
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+type UserType int
+
+const (
+	UserTypeNormal UserType = iota
+	UserTypeAdmin
+	UserTypeGlobalMod
+	UserTypeStaff
+	UserTypeMod
+)
+
+var userTypeLookup = map[string]UserType{
+	"":           UserTypeNormal,
+	"admin":      UserTypeAdmin,
+	"global_mod": UserTypeGlobalMod,
+	"staff":      UserTypeStaff,
+	"mod":        UserTypeMod,
+}
+
+// String returns the user type as twitch sends it
+func (userType UserType) String() string {
+	for str, lookup := range userTypeLookup {
+		if lookup == userType {
+			return str
+		}
+	}
+	return ""
+}
+
+// color=#RRGGBB
+func getColorFromTags(tags map[string]string, key string) Color {
+	str := getStringFromTags(tags, key)
+	if len(str) != 7 || str[0] != '#' {
+		return Color{}
+	}
+
+	rgb, err := strconv.ParseUint(str[1:], 16, 32)
+	if err != nil {
+		return Color{}
+	}
+	return Color{
+		R:     uint8(rgb >> 16),
+		G:     uint8(rgb >> 8),
+		B:     uint8(rgb),
+		Valid: true,
+	}
+}
+
+// Timestamps are in milliseconds since the unix epoch
+func getTimeFromTags(tags map[string]string, key string) time.Time {
+	str := getStringFromTags(tags, key)
+	if str != "" {
+		if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	return time.Time{}
+}
+
+// Unknown user types are treated as normal users
+func getUserTypeFromTags(tags map[string]string, key string) UserType {
+	return userTypeLookup[getStringFromTags(tags, key)]
+}
+
+// Comma separated list
+func getListFromTags(tags map[string]string, key string) []string {
+	str := getStringFromTags(tags, key)
+	if str == "" {
+		return nil
+	}
+	return strings.Split(str, ",")
+}
@@ -0,0 +1,199 @@
+package twitchchat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a connection to twitch that sends and receives raw irc messages
+type Conn interface {
+	// ReadMessage blocks until data is received. The data can hold any
+	// number of messages separated by "\r\n"
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage writes a single message terminated by "\r\n"
+	WriteMessage(data []byte) error
+
+	Close() error
+}
+
+// Transport dials connections to twitch
+type Transport interface {
+	Dial(ctx context.Context) (Conn, error)
+}
+
+var (
+	// Plain websocket on port 80. This is the default transport
+	TwitchWebsocket Transport = &WebsocketTransport{URL: "ws://irc-ws.chat.twitch.tv:80"}
+
+	// Websocket over TLS on port 443
+	TwitchSecureWebsocket Transport = &WebsocketTransport{URL: "wss://irc-ws.chat.twitch.tv:443"}
+
+	// Plain irc over TCP on port 6667
+	TwitchIrc Transport = &TCPTransport{Addr: "irc.chat.twitch.tv:6667"}
+
+	// Irc over TLS on port 6697
+	TwitchSecureIrc Transport = &TCPTransport{Addr: "irc.chat.twitch.tv:6697", TLSConfig: &tls.Config{}}
+)
+
+// WebsocketTransport connects to twitch through a websocket. Every
+// websocket message can hold several irc messages
+type WebsocketTransport struct {
+	URL string
+
+	// Defaults to websocket.DefaultDialer
+	Dialer *websocket.Dialer
+}
+
+func (t *WebsocketTransport) Dial(ctx context.Context) (Conn, error) {
+	dialer := t.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	ws, _, err := dialer.DialContext(ctx, t.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &websocketConn{ws: ws}, nil
+}
+
+type websocketConn struct {
+	ws *websocket.Conn
+}
+
+func (c *websocketConn) ReadMessage() ([]byte, error) {
+	_, message, err := c.ws.ReadMessage()
+	return message, err
+}
+
+func (c *websocketConn) WriteMessage(data []byte) error {
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *websocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// TCPTransport connects to twitch with plain irc over TCP, using TLS when
+// TLSConfig isn't nil
+type TCPTransport struct {
+	Addr      string
+	TLSConfig *tls.Config
+}
+
+func (t *TCPTransport) Dial(ctx context.Context) (Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.TLSConfig != nil {
+		config := t.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(t.Addr)
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	return NewLineConn(conn), nil
+}
+
+// NewLineConn wraps a stream of "\r\n" terminated irc messages, such as a
+// TCP connection, as a Conn that reads a single message at a time
+func NewLineConn(conn net.Conn) Conn {
+	return &lineConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+type lineConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *lineConn) ReadMessage() ([]byte, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func (c *lineConn) WriteMessage(data []byte) error {
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *lineConn) Close() error {
+	return c.conn.Close()
+}
+
+var ErrTransportClosed = errors.New("transport closed")
+
+// MemoryTransport dials in memory pipes instead of twitch, so that tests can
+// play the part of the server. The server end of every dialed pipe is handed
+// out by Accept
+type MemoryTransport struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial blocks until the pipe is accepted
+func (t *MemoryTransport) Dial(ctx context.Context) (Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case t.conns <- server:
+		return NewLineConn(client), nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept returns the server end of the next dialed pipe
+func (t *MemoryTransport) Accept() (net.Conn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Close makes every pending and future Dial and Accept fail
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
@@ -0,0 +1,76 @@
+package twitchchat
+
+import (
+	"bufio"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	defer transport.Close()
+
+	outChan := make(chan IrcMessage)
+	irc, _ := NewIrc()
+	irc.Transport = transport
+
+	connectErr := make(chan error, 1)
+	go func() {
+		connectErr <- irc.Connect("ronni", "secret", true, outChan)
+	}()
+
+	server, err := transport.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	reader := bufio.NewReader(server)
+	expected := []string{
+		"CAP REQ :twitch.tv/tags twitch.tv/commands twitch.tv/membership\r\n",
+		"PASS oauth:secret\r\n",
+		"NICK ronni\r\n",
+	}
+	for _, line := range expected {
+		received, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received != line {
+			t.Error("Wrong line: " + received)
+		}
+	}
+	if err := <-connectErr; err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Write([]byte("PING :tmi.twitch.tv\r\n:ronni!ronni@ronni.tmi.twitch.tv JOIN #dallas\r\n"))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-outChan:
+			switch i {
+			case 0:
+				if _, ok := msg.(*Ping); !ok {
+					t.Errorf("Expected ping, got %T", msg)
+				}
+			case 1:
+				if _, ok := msg.(*Join); !ok {
+					t.Errorf("Expected join, got %T", msg)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+
+	server.Close()
+	select {
+	case <-irc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Connection not done after server closed")
+	}
+	if irc.Err() == nil {
+		t.Error("No error after server closed")
+	}
+}
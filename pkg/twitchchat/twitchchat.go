@@ -1,29 +1,54 @@
 package twitchchat
 
 import (
+	"context"
 	"errors"
-	"reflect"
+	"log"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-const twitchChatUrl = "ws://irc-ws.chat.twitch.tv:80"
-
 type chatMsg struct {
+	channel  string
+	message  string
+	tags     map[string]string
+	opts     EventOptions
+	result   *SendResult
+	ctx      context.Context
+	attempts int // Times twitch asked to send the message again later
+}
+
+// Key queues chat messages per channel
+func (msg chatMsg) Key() string {
+	return channelKey(msg.channel)
+}
+
+func (msg chatMsg) discard(err error) {
+	msg.result.resolve(err)
+}
+
+type joinMsg struct {
 	channel string
-	message string
+	irc     *Irc        // Defaults to the current connection
+	result  *SendResult // Nil when rejoining
+}
+
+func (msg joinMsg) discard(err error) {
+	if msg.result != nil {
+		msg.result.resolve(err)
+	}
 }
 
 type chatEmitter struct {
 	Emitter
-	irc *Irc
+	tc *TwitchChat
 }
 
-func newChatEmitter(irc *Irc) *chatEmitter {
+func newChatEmitter(tc *TwitchChat) *chatEmitter {
 	return &chatEmitter{
-		irc: irc,
+		tc: tc,
 	}
 }
 
@@ -33,49 +58,138 @@ func (em *chatEmitter) Emit(event Event) error {
 		// todo
 		return nil
 	}
-	return em.irc.Privmsg(msg.channel, msg.message)
+
+	text, err := em.tc.chatLimiter.unique(msg)
+	if err != nil {
+		msg.result.resolve(err)
+		return err
+	}
+	// Retries and rejections are about the text that was sent
+	msg.message = text
+
+	failed := em.tc.confirmations.expectChat(msg)
+	err = em.tc.currentIrc().PrivmsgWithTags(msg.channel, msg.message, msg.tags)
+	if err != nil {
+		failed(err)
+		return err
+	}
+	em.tc.chatLimiter.sent(msg.channel, msg.message)
+	return nil
+}
+
+// OnError does nothing, errors are reported through the SendResult
+func (em *chatEmitter) OnError(err error) {
+}
+
+func (em *chatEmitter) Close() error {
+	return nil
 }
 
 type joinEmitter struct {
 	Emitter
-	irc *Irc
+	tc *TwitchChat
 }
 
-func newJoinEmitter(irc *Irc) *joinEmitter {
+func newJoinEmitter(tc *TwitchChat) *joinEmitter {
 	return &joinEmitter{
-		irc: irc,
+		tc: tc,
 	}
 }
 
 func (em *joinEmitter) Emit(event Event) error {
-	channel, ok := event.(string)
+	msg, ok := event.(joinMsg)
 	if !ok {
 		// todo
 		return nil
 	}
 
-	return em.irc.Join(channel)
+	irc := msg.irc
+	if irc == nil {
+		irc = em.tc.currentIrc()
+	}
+	if msg.result == nil {
+		// Rejoining after a reconnect, nobody is waiting for the result
+		err := irc.Join(msg.channel)
+		if err != nil {
+			log.Println("Couldn't join channel:", err)
+		}
+		return err
+	}
+
+	failed := em.tc.confirmations.expectJoin(msg.channel, msg.result)
+	err := irc.Join(msg.channel)
+	if err != nil {
+		failed(err)
+	}
+	return err
+}
+
+// OnError does nothing, errors are reported through the SendResult
+func (em *joinEmitter) OnError(err error) {
+}
+
+func (em *joinEmitter) Close() error {
+	return nil
 }
 
 type Options struct {
 	Nick       string
 	Pass       string
-	ChatLimit  int // Defaults to 20
-	JoinLimit  int // Defaults to 20
-	AuthLimit  int // Defaults to 20
 	EnableTags bool
+
+	RateProfile RateProfile // Defaults to NormalProfile
+	ChatLimit   int         // Overrides RateProfile.Chat.Count
+	JoinLimit   int         // Overrides RateProfile.Join.Count
+	AuthLimit   int         // Overrides RateProfile.Auth.Count
+
+	DisableReconnect     bool
+	MinReconnectDelay    time.Duration // Defaults to 1 second
+	MaxReconnectDelay    time.Duration // Defaults to 2 minutes
+	MaxReconnectAttempts int           // Defaults to retrying forever
+
+	Transport Transport // Defaults to TwitchWebsocket
+
+	// Number of goroutines calling callbacks. Channels are handled in
+	// parallel, messages of one channel in the order they were received.
+	// Defaults to calling all callbacks from a single goroutine
+	DispatchWorkers   int
+	DispatchQueueSize int            // Per worker, defaults to 64
+	DispatchOverflow  OverflowPolicy // Defaults to OverflowBlock
+
+	// Most chat messages waiting to be sent, defaults to no limit. What
+	// happens to a message that doesn't fit is decided by ChatQueueOverflow,
+	// its result fails with ErrBucketFull when it is dropped. With
+	// OverflowBlock chatting waits for room
+	ChatQueueSize     int
+	ChatQueueOverflow OverflowPolicy
+
+	// What to do with a chat message twitch would reject for being the same
+	// as the previous one, defaults to DuplicateSend
+	ChatDuplicates DuplicatePolicy
+
+	// Drop the queued chat messages on Shutdown instead of sending them
+	DiscardOnShutdown bool
 }
 
 type TwitchChat struct {
 	irc           *Irc
 	ircChan       chan IrcMessage
+	stop          chan struct{}
+	done          chan struct{} // Closed once handleIrcMessage returns
+	connMutex     sync.Mutex
 	options       Options
-	messageRouter map[string]interface{}
+	messageRouter *router
+	confirmations *confirmations
 	privMsgBucket *Bucket
 	joinBucket    *Bucket
+	chatLimiter   *chatLimiter
+	authLimiter   *rate.Limiter
 
 	joinChannelMutex sync.RWMutex
-	joinedChannels   map[string]bool
+	joinedChannels   map[string]*SendResult // Result of the latest join, by channelKey
+
+	subscriberMutex sync.Mutex
+	subscribers     map[<-chan IrcMessage]*subscriber
 }
 
 func NewTwitchChat(options *Options) (*TwitchChat, error) {
@@ -90,104 +204,365 @@ func NewTwitchChat(options *Options) (*TwitchChat, error) {
 	tc := new(TwitchChat)
 	tc.options = *options
 
-	if tc.options.ChatLimit == 0 {
-		tc.options.ChatLimit = 20
+	if tc.options.RateProfile == (RateProfile{}) {
+		tc.options.RateProfile = NormalProfile
+	}
+	if tc.options.ChatLimit != 0 {
+		tc.options.RateProfile.Chat.Count = tc.options.ChatLimit
+	}
+	if tc.options.JoinLimit != 0 {
+		tc.options.RateProfile.Join.Count = tc.options.JoinLimit
+	}
+	if tc.options.AuthLimit != 0 {
+		tc.options.RateProfile.Auth.Count = tc.options.AuthLimit
+	}
+	if tc.options.MinReconnectDelay == 0 {
+		tc.options.MinReconnectDelay = time.Second
 	}
-	if tc.options.JoinLimit == 0 {
-		tc.options.JoinLimit = 20
+	if tc.options.MaxReconnectDelay == 0 {
+		tc.options.MaxReconnectDelay = 2 * time.Minute
 	}
-	if tc.options.AuthLimit == 0 {
-		tc.options.AuthLimit = 20
+	if tc.options.MaxReconnectDelay < tc.options.MinReconnectDelay {
+		tc.options.MaxReconnectDelay = tc.options.MinReconnectDelay
+	}
+	if tc.options.DispatchQueueSize == 0 {
+		tc.options.DispatchQueueSize = 64
 	}
 
-	tc.messageRouter = make(map[string]interface{})
+	tc.messageRouter = newRouter()
+	tc.confirmations = newConfirmations(tc.options.Nick)
+	tc.confirmations.rejected = tc.chatRejected
 
-	tc.joinedChannels = make(map[string]bool)
+	tc.joinedChannels = make(map[string]*SendResult)
+	tc.subscribers = make(map[<-chan IrcMessage]*subscriber)
 
 	var err error
 	tc.irc, err = NewIrc()
 
-	tc.RegisterCallback(tc.Pong)
-
-	tc.privMsgBucket = NewBucket(newChatEmitter(tc.irc),
-		rate.Every(time.Duration(30/tc.options.ChatLimit)*time.Second), 1)
-	tc.joinBucket = NewBucket(newJoinEmitter(tc.irc),
-		rate.Every(time.Duration(30/tc.options.JoinLimit)*time.Second), 1)
+	profile := tc.options.RateProfile
+	tc.chatLimiter = newChatLimiter(profile)
+	tc.chatLimiter.duplicates = tc.options.ChatDuplicates
+	tc.authLimiter = profile.Auth.limiter()
+	tc.privMsgBucket = NewBucketWithLimiter(newChatEmitter(tc), tc.chatLimiter)
+	tc.privMsgBucket.SetCapacity(tc.options.ChatQueueSize, tc.options.ChatQueueOverflow)
+	tc.joinBucket = NewBucketWithLimiter(newJoinEmitter(tc), singleLimiter{profile.Join.limiter()})
+	// Channels whose join is dropped before being sent aren't joined again
+	// after reconnecting
+	tc.joinBucket.OnDrop(func(event Event, err error) {
+		if msg, ok := event.(joinMsg); ok && msg.result != nil {
+			tc.forgetChannel(msg.channel, msg.result)
+		}
+	})
 	return tc, err
 }
 
+// Connect to twitch. If the connection drops it is reestablished until
+// Disconnect is called, see Options for how reconnecting is done
 func (tc *TwitchChat) Connect() error {
-	tc.ircChan = make(chan IrcMessage)
+	return tc.ConnectContext(context.Background())
+}
+
+// ConnectContext connects like Connect. Dialing is aborted when ctx is done,
+// once connected ctx has no effect
+func (tc *TwitchChat) ConnectContext(ctx context.Context) error {
+	c, err := tc.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	ircChan := make(chan IrcMessage)
+	stop := make(chan struct{})
+	done := make(chan struct{})
 
-	go tc.handleIrcMessage()
+	tc.connMutex.Lock()
+	tc.irc = c.irc
+	tc.ircChan = ircChan
+	tc.stop = stop
+	tc.done = done
+	tc.connMutex.Unlock()
 
-	return tc.irc.Connect(tc.options.Nick, tc.options.Pass, tc.options.EnableTags, tc.ircChan)
+	go tc.handleIrcMessage(ircChan, done)
+	go tc.superviseConnection(c, ircChan, stop)
+
+	return nil
 }
 
 func (tc *TwitchChat) Disconnect() error {
-	err := tc.irc.Disconnect()
-	tc.joinedChannels = make(map[string]bool)
+	tc.connMutex.Lock()
+	if tc.stop != nil && !isClosed(tc.stop) {
+		close(tc.stop)
+	}
+	irc := tc.irc
+	tc.connMutex.Unlock()
+
+	err := irc.Disconnect()
+
+	tc.joinChannelMutex.Lock()
+	tc.joinedChannels = make(map[string]*SendResult)
+	tc.joinChannelMutex.Unlock()
 	return err
 }
 
-func (tc *TwitchChat) handleIrcMessage() {
-	for msg := range tc.ircChan {
-		arg := reflect.ValueOf(msg)
-		if cb, ok := tc.messageRouter[arg.Type().Elem().String()]; ok {
-			refCb := reflect.ValueOf(cb)
-			if refCb.Kind() == reflect.Func {
-				refCb.Call([]reflect.Value{arg})
-			}
-		}
+// DisconnectContext disconnects like Disconnect and waits until the
+// remaining messages have been dispatched and all goroutines handling the
+// connection have stopped, or ctx is done
+func (tc *TwitchChat) DisconnectContext(ctx context.Context) error {
+	err := tc.Disconnect()
+
+	tc.connMutex.Lock()
+	done := tc.done
+	tc.connMutex.Unlock()
+	if done == nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown sends the queued chat messages, parts every channel and
+// disconnects, then waits until all goroutines have stopped. Messages still
+// queued when ctx is done are dropped. The TwitchChat can't be used to chat
+// or join channels afterwards
+func (tc *TwitchChat) Shutdown(ctx context.Context) error {
+	tc.joinBucket.Close()
+
+	var err error
+	if tc.options.DiscardOnShutdown {
+		tc.privMsgBucket.Close()
+	} else {
+		err = tc.privMsgBucket.CloseContext(ctx)
 	}
+
+	irc := tc.currentIrc()
+	tc.joinChannelMutex.RLock()
+	for channel := range tc.joinedChannels {
+		irc.Part(channel)
+	}
+	tc.joinChannelMutex.RUnlock()
+
+	if dErr := tc.DisconnectContext(ctx); err == nil && !errors.Is(dErr, ErrNotConnected) {
+		err = dErr
+	}
+	return err
+}
+
+func (tc *TwitchChat) currentIrc() *Irc {
+	tc.connMutex.Lock()
+	defer tc.connMutex.Unlock()
+	return tc.irc
 }
 
-func (tc *TwitchChat) RegisterCallback(cb interface{}) error {
-	v := reflect.ValueOf(cb)
-	if v.Kind() != reflect.Func {
-		return errors.New("not a function")
+func (tc *TwitchChat) handleIrcMessage(ircChan <-chan IrcMessage, done chan<- struct{}) {
+	// ircChan is closed once the connection is closed for good
+	defer close(done)
+	defer tc.closeSubscribers()
+	defer tc.confirmations.clear(ErrNoConfirmation)
+
+	if tc.options.DispatchWorkers <= 0 {
+		for msg := range ircChan {
+			tc.observe(msg)
+			tc.messageRouter.handle(msg)
+		}
+		return
 	}
 
-	if v.Type().NumIn() != 1 {
-		return errors.New("too many args")
+	d := newDispatcher(tc.messageRouter.handle, tc.options.DispatchWorkers,
+		tc.options.DispatchQueueSize, tc.options.DispatchOverflow)
+	defer d.close()
+	for msg := range ircChan {
+		tc.observe(msg)
+		d.dispatch(msg)
 	}
+}
 
-	ti := v.Type().In(0)
-	if ti.Kind() != reflect.Ptr {
-		return errors.New("wrong type of arg")
+// observe keeps track of what twitch tells about the messages we send, before
+// msg is dispatched
+func (tc *TwitchChat) observe(msg IrcMessage) {
+	// Pause before rejected messages are queued again
+	tc.chatLimiter.observe(msg)
+	tc.confirmations.observe(msg)
+
+	// Channels we can't join aren't joined again after reconnecting
+	if notice, ok := msg.(*Notice); ok && joinRejections[notice.MsgId] {
+		tc.joinChannelMutex.Lock()
+		delete(tc.joinedChannels, notice.Channel)
+		tc.joinChannelMutex.Unlock()
 	}
+}
 
-	tc.messageRouter[ti.Elem().String()] = cb
+// RegisterCallback adds cb to the callbacks for the message type it takes,
+// which has to be a pointer such as func(*PrivMsg). cb may return an error,
+// which is dispatched as *CallbackError. Callbacks are called in the order
+// they were registered. Can be called while connected. On does the same with
+// the type of cb checked at compile time
+func (tc *TwitchChat) RegisterCallback(cb interface{}) (*Subscription, error) {
+	return tc.messageRouter.register(cb)
+}
 
-	return nil
+// Chat queues msg to be sent to channel. The result resolves once twitch has
+// confirmed or rejected the message
+func (tc *TwitchChat) Chat(channel, msg string) *SendResult {
+	return tc.ChatContext(context.Background(), channel, msg)
 }
 
-func (tc *TwitchChat) Chat(channel, msg string) error {
-	tc.privMsgBucket.AddEvent(chatMsg{
+// ChatContext queues msg like Chat. It is dropped if ctx is done before it
+// could be sent
+func (tc *TwitchChat) ChatContext(ctx context.Context, channel, msg string) *SendResult {
+	return tc.chat(ctx, chatMsg{
 		channel: channel,
 		message: msg,
+	})
+}
+
+// ChatWithOptions queues msg like ChatContext, with its priority, TTL and
+// coalesce key set by opts. Messages of higher priority are sent first, such
+// as moderation actions before command replies before timer messages. Only
+// messages to the same channel are coalesced
+func (tc *TwitchChat) ChatWithOptions(ctx context.Context, channel, msg string, opts EventOptions) *SendResult {
+	return tc.chat(ctx, chatMsg{
+		channel: channel,
+		message: msg,
+		opts:    opts,
+	})
+}
+
+// ChatWithTags sends msg along with tags such as "reply-parent-msg-id"
+func (tc *TwitchChat) ChatWithTags(channel, msg string, tags map[string]string) *SendResult {
+	return tc.chat(context.Background(), chatMsg{
+		channel: channel,
+		message: msg,
+		tags:    tags,
+	})
+}
+
+// Reply sends msg as a reply to parent
+func (tc *TwitchChat) Reply(parent *PrivMsg, msg string) *SendResult {
+	return tc.ChatWithTags(parent.Channel, msg, map[string]string{
+		"reply-parent-msg-id": parent.Id,
+	})
+}
+
+func (tc *TwitchChat) chat(ctx context.Context, msg chatMsg) *SendResult {
+	msg.result = newSendResult()
+	msg.ctx = ctx
+	if err := tc.privMsgBucket.AddEventWithOptions(ctx, msg, msg.opts); err != nil {
+		msg.result.resolve(err)
+	}
+	return msg.result
+}
+
+// QueuedMessages returns the number of chat messages waiting to be sent per
+// channel
+func (tc *TwitchChat) QueuedMessages() map[string]int {
+	return tc.privMsgBucket.QueueLens()
+}
+
+// SetChannelWeight makes channel send up to weight queued messages in a row
+// when it is its turn. Channels take turns with a weight of 1 by default
+func (tc *TwitchChat) SetChannelWeight(channel string, weight int) {
+	tc.privMsgBucket.SetWeight(channelKey(channel), weight)
+}
+
+// chatRejected forgets a rejected message as the last one sent to its
+// channel, and queues it again if twitch asked to send it later
+func (tc *TwitchChat) chatRejected(event Event, notice *Notice) bool {
+	if msg, ok := event.(chatMsg); ok {
+		tc.chatLimiter.unsent(msg.channel, msg.message)
+	}
+	return tc.retryChat(event, notice)
+}
+
+// How often a chat message is sent again when twitch says we are sending too
+// fast, before giving up
+const maxChatAttempts = 3
+
+// retryChat queues a message twitch rejected for being sent too fast again,
+// with at least high priority. chatLimiter has already paused sending by then
+func (tc *TwitchChat) retryChat(event Event, notice *Notice) bool {
+	msg, ok := event.(chatMsg)
+	if !ok || msg.attempts >= maxChatAttempts {
+		return false
+	}
+	switch notice.MsgId {
+	case "msg_ratelimit", "msg_slowmode":
+	default:
+		return false
+	}
+
+	msg.attempts++
+	opts := msg.opts
+	if opts.Priority < PriorityHigh {
+		opts.Priority = PriorityHigh
+	}
+	// A newer message replacing this one may already be queued
+	opts.Coalesce = ""
+	// The message already had its room in the queue
+	if err := tc.privMsgBucket.add(msg.ctx, msg, opts, false); err != nil {
+		msg.result.resolve(err)
+	}
+	return true
+}
+
+// Join queues joining channel. The result resolves once twitch has confirmed
+// or rejected the join. The channel is joined again after reconnecting,
+// unless the join was dropped or rejected
+func (tc *TwitchChat) Join(channel string) *SendResult {
+	return tc.JoinContext(context.Background(), channel)
+}
+
+// JoinContext queues joining channel like Join. The join is dropped if ctx
+// is done before it could be sent
+func (tc *TwitchChat) JoinContext(ctx context.Context, channel string) *SendResult {
+	result := newSendResult()
+	channel = channelKey(channel)
+
+	// Added before queuing, the join may be dropped straight away
+	tc.joinChannelMutex.Lock()
+	tc.joinedChannels[channel] = result
+	tc.joinChannelMutex.Unlock()
+
+	err := tc.joinBucket.AddEventContext(ctx, joinMsg{
+		channel: channel,
+		result:  result,
 	}, false)
-	return nil
+	if err != nil {
+		tc.forgetChannel(channel, result)
+		result.resolve(err)
+	}
+	return result
 }
 
-func (tc *TwitchChat) Join(channel string) error {
-	defer tc.joinChannelMutex.Unlock()
-	tc.joinBucket.AddEvent(channel, false)
+// forgetChannel stops joining channel again after reconnecting, unless it
+// has been joined again since the join that resolves result
+func (tc *TwitchChat) forgetChannel(channel string, result *SendResult) {
+	channel = channelKey(channel)
+
 	tc.joinChannelMutex.Lock()
-	tc.joinedChannels[channel] = true
-	return nil
+	defer tc.joinChannelMutex.Unlock()
+	if tc.joinedChannels[channel] == result {
+		delete(tc.joinedChannels, channel)
+	}
 }
 
 func (tc *TwitchChat) Part(channel string) error {
+	channel = channelKey(channel)
+
 	defer tc.joinChannelMutex.Unlock()
 	tc.joinChannelMutex.Lock()
 	delete(tc.joinedChannels, channel)
-	return tc.irc.Part(channel)
+	return tc.currentIrc().Part(channel)
 }
 
+// Pong answers ping. Pings are already answered on the connection they
+// arrived on, so there's no need to register this as a callback
 func (tc *TwitchChat) Pong(ping *Ping) {
 	for _, server := range ping.Servers {
-		err := tc.irc.Pong(server)
+		err := tc.currentIrc().Pong(server)
 		if err != nil {
 			// todo
 		}
@@ -0,0 +1,607 @@
+package twitchchat_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/beardsleyn/go-twitch/pkg/twitchchat"
+	"github.com/beardsleyn/go-twitch/pkg/twitchchattest"
+)
+
+const timeout = 5 * time.Second
+
+func newTestChat(t *testing.T, srv *twitchchattest.Server) *twitchchat.TwitchChat {
+	tc, err := twitchchat.NewTwitchChat(&twitchchat.Options{
+		Nick:              "ronni",
+		Pass:              "secret",
+		EnableTags:        true,
+		Transport:         srv.Transport(),
+		MinReconnectDelay: 10 * time.Millisecond,
+		MaxReconnectDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestTwitchChat(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Pass = "secret"
+
+	tc := newTestChat(t, srv)
+	privMsgs := make(chan *twitchchat.PrivMsg, 10)
+	tc.RegisterCallback(func(msg *twitchchat.PrivMsg) {
+		privMsgs <- msg
+	})
+	joins := make(chan *twitchchat.Join, 10)
+	tc.RegisterCallback(func(msg *twitchchat.Join) {
+		joins <- msg
+	})
+	notices := make(chan twitchchat.IrcMessage, 10)
+	tc.RegisterCallback(func(msg *twitchchat.UserNotice) {
+		notices <- msg
+	})
+	tc.RegisterCallback(func(msg *twitchchat.Raid) {
+		notices <- msg
+	})
+
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	if _, err := srv.WaitForCommand(timeout, "NICK", "ronni"); err != nil {
+		t.Fatal("NICK not sent")
+	}
+
+	tc.Join("dallas")
+	select {
+	case join := <-joins:
+		if join.Channel != "dallas" || join.Nickname != "ronni" {
+			t.Error("Wrong join: " + join.Channel + " " + join.Nickname)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Join not received")
+	}
+
+	id := srv.SendPrivmsg("dallas", "bob", "Kappa Keepo Kappa", nil)
+	var privMsg *twitchchat.PrivMsg
+	select {
+	case privMsg = <-privMsgs:
+		if privMsg.Id != id || privMsg.Message != "Kappa Keepo Kappa" || privMsg.Nickname != "bob" {
+			t.Error("Wrong message: " + string(privMsg.RawMessage))
+		}
+	case <-time.After(timeout):
+		t.Fatal("PrivMsg not received")
+	}
+
+	srv.SendUserNotice("dallas", "bob", "raid", "15 raiders from bob have joined!", "", map[string]string{
+		"msg-param-viewerCount": "15",
+	})
+	srv.SendUserNotice("dallas", "bob", "sub", "bob subscribed at Tier 1.", "", nil)
+	for _, expected := range []string{"*twitchchat.Raid", "*twitchchat.UserNotice"} {
+		select {
+		case msg := <-notices:
+			if received := fmt.Sprintf("%T", msg); received != expected {
+				t.Error("Expected " + expected + " got " + received)
+			}
+		case <-time.After(timeout):
+			t.Fatal("UserNotice not received")
+		}
+	}
+
+	tc.Chat("dallas", "HeyGuys")
+	if _, err := srv.WaitForCommand(timeout, "PRIVMSG", "#dallas", "HeyGuys"); err != nil {
+		t.Error("PRIVMSG not sent")
+	}
+
+	tc.Reply(privMsg, "VoHiYo back")
+	if msg, err := srv.WaitForCommand(timeout, "PRIVMSG", "#dallas", "VoHiYo back"); err != nil {
+		t.Error("Reply not sent")
+	} else if msg.Tags["reply-parent-msg-id"] != id {
+		t.Error("Wrong reply parent: " + msg.Raw)
+	}
+}
+
+func TestTwitchChatReconnect(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc := newTestChat(t, srv)
+	connected := make(chan *twitchchat.Connected, 10)
+	tc.RegisterCallback(func(msg *twitchchat.Connected) {
+		connected <- msg
+	})
+	disconnected := make(chan *twitchchat.Disconnected, 10)
+	tc.RegisterCallback(func(msg *twitchchat.Disconnected) {
+		disconnected <- msg
+	})
+
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	tc.Join("dallas")
+	if _, err := srv.WaitForCommand(timeout, "JOIN", "#dallas"); err != nil {
+		t.Fatal("JOIN not sent")
+	}
+	<-connected
+
+	srv.DropClients()
+
+	select {
+	case msg := <-disconnected:
+		if msg.Err == nil {
+			t.Error("Dropped connection without error")
+		}
+	case <-time.After(timeout):
+		t.Fatal("Disconnect not dispatched")
+	}
+
+	select {
+	case msg := <-connected:
+		if !msg.Reconnect {
+			t.Error("Not a reconnect")
+		}
+	case <-time.After(timeout):
+		t.Fatal("Didn't reconnect")
+	}
+
+	joins := 0
+	_, err = srv.WaitFor(timeout, func(msg twitchchattest.Message) bool {
+		if msg.Command == "JOIN" {
+			joins++
+		}
+		return joins == 2
+	})
+	if err != nil {
+		t.Error("Channel not rejoined")
+	}
+}
+
+func TestTwitchChatCancelledJoin(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc := newTestChat(t, srv)
+	connected := make(chan *twitchchat.Connected, 10)
+	tc.RegisterCallback(func(msg *twitchchat.Connected) {
+		connected <- msg
+	})
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+	<-connected
+
+	tc.Join("dallas")
+	if _, err := srv.WaitForCommand(timeout, "JOIN", "#dallas"); err != nil {
+		t.Fatal("JOIN not sent")
+	}
+	// The second join waits for the join rate limit
+	ctx, cancel := context.WithCancel(context.Background())
+	result := tc.JoinContext(ctx, "austin")
+	cancel()
+	if err := result.Wait(context.Background()); err != context.Canceled {
+		t.Error("Join not cancelled: " + fmt.Sprint(err))
+	}
+
+	srv.DropClients()
+	select {
+	case <-connected:
+	case <-time.After(timeout):
+		t.Fatal("Didn't reconnect")
+	}
+
+	joins := 0
+	_, err = srv.WaitFor(timeout, func(msg twitchchattest.Message) bool {
+		if msg.Command == "JOIN" && msg.Params[0] == "#dallas" {
+			joins++
+		}
+		return joins == 2
+	})
+	if err != nil {
+		t.Error("Channel not rejoined")
+	}
+	if _, err := srv.WaitForCommand(time.Second, "JOIN", "#austin"); err == nil {
+		t.Error("Cancelled join sent after reconnecting")
+	}
+}
+
+func TestTwitchChatHandover(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc := newTestChat(t, srv)
+	// Ids of the chat messages and resubs, in the order they arrived
+	received := make(chan string, 1000)
+	tc.RegisterCallback(func(msg *twitchchat.PrivMsg) {
+		received <- msg.Id
+	})
+	tc.RegisterCallback(func(msg *twitchchat.Resub) {
+		received <- msg.Id
+	})
+	joins := make(chan *twitchchat.Join, 10)
+	tc.RegisterCallback(func(msg *twitchchat.Join) {
+		joins <- msg
+	})
+
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	tc.Join("dallas")
+	<-joins
+
+	numMsgs := 300
+	ids := make(chan string, numMsgs)
+	go func() {
+		for i := 0; i < numMsgs; i++ {
+			if i == 20 {
+				srv.SendReconnect()
+			}
+			if i%2 == 0 {
+				ids <- srv.SendPrivmsg("dallas", "bob", "hi", nil)
+			} else {
+				ids <- srv.SendUserNotice("dallas", "bob", "resub", "bob subscribed for 3 months!", "hi",
+					map[string]string{"msg-param-cumulative-months": "3"})
+			}
+			// Keep up a steady stream during the handover, so that some
+			// messages arrive on both connections
+			if i < 20 {
+				time.Sleep(10 * time.Millisecond)
+			} else {
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+		close(ids)
+	}()
+
+	for id := range ids {
+		select {
+		case got := <-received:
+			if got != id {
+				t.Fatal("Expected " + id + " got " + got)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Message " + id + " lost")
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Error("Duplicate message " + got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	nicks := 0
+	for _, msg := range srv.Received() {
+		if msg.Command == "NICK" {
+			nicks++
+		}
+	}
+	if nicks != 2 {
+		t.Error("No new connection made")
+	}
+	if clients := srv.Clients(); clients != 1 {
+		t.Error("Old connection not closed")
+	}
+}
+
+func TestTwitchChatHandoverMixedCase(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc := newTestChat(t, srv)
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	// Twitch echoes the join as #dallas
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tc.Join("Dallas").Wait(ctx); err != nil {
+		t.Fatal("Join not confirmed: " + err.Error())
+	}
+
+	srv.SendReconnect()
+	deadline := time.Now().Add(timeout)
+	for {
+		nicks := 0
+		for _, msg := range srv.Received() {
+			if msg.Command == "NICK" {
+				nicks++
+			}
+		}
+		if nicks == 2 && srv.Clients() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Handover not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTwitchChatSubscribe(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc := newTestChat(t, srv)
+	msgs := tc.Subscribe(twitchchat.Filter{
+		Types:   []twitchchat.IrcMessage{(*twitchchat.PrivMsg)(nil)},
+		Channel: "dallas",
+	})
+
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Join("dallas")
+	tc.Join("austin")
+	if _, err := srv.WaitForCommand(timeout, "JOIN", "#austin"); err != nil {
+		t.Fatal("JOIN not sent")
+	}
+
+	srv.SendPrivmsg("austin", "bob", "wrong channel", nil)
+	srv.SendPrivmsg("dallas", "bob", "right channel", nil)
+	select {
+	case msg := <-msgs:
+		if msg.(*twitchchat.PrivMsg).Message != "right channel" {
+			t.Error("Wrong message: " + string(msg.(*twitchchat.PrivMsg).RawMessage))
+		}
+	case <-time.After(timeout):
+		t.Fatal("PrivMsg not received")
+	}
+
+	tc.Disconnect()
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Error("Unexpected message")
+		}
+	case <-time.After(timeout):
+		t.Error("Channel not closed on disconnect")
+	}
+}
+
+func TestTwitchChatContext(t *testing.T) {
+	transport := twitchchat.NewMemoryTransport()
+	defer transport.Close()
+	tc, err := twitchchat.NewTwitchChat(&twitchchat.Options{
+		Nick:      "ronni",
+		Pass:      "secret",
+		Transport: transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody accepts the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tc.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Error("Dialing not aborted: " + fmt.Sprint(err))
+	}
+
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tc = newTestChat(t, srv)
+	disconnected := false
+	tc.RegisterCallback(func(msg *twitchchat.Disconnected) {
+		disconnected = true
+	})
+	if err := tc.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tc.DisconnectContext(ctx); err != nil {
+		t.Error(err)
+	}
+	if !disconnected {
+		t.Error("Disconnected not dispatched before returning")
+	}
+}
+
+func TestTwitchChatShutdown(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	tc := newTestChat(t, srv)
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Join("dallas")
+	if _, err := srv.WaitForCommand(timeout, "JOIN", "#dallas"); err != nil {
+		t.Fatal("JOIN not sent")
+	}
+	tc.Chat("dallas", "first")
+	tc.Chat("dallas", "second")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tc.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+
+	for _, expected := range [][]string{{"PRIVMSG", "#dallas", "second"}, {"PART", "#dallas"}} {
+		if _, err := srv.WaitForCommand(timeout, expected[0], expected[1:]...); err != nil {
+			t.Error(expected[0] + " not sent")
+		}
+	}
+	if err := tc.Chat("dallas", "too late").Err(); err != twitchchat.ErrBucketClosed {
+		t.Error("No error chatting after shutdown")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaked := runtime.NumGoroutine() - goroutines; leaked > 0 {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines leaked\n%s", leaked, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestTwitchChatResults(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Reject = func(channel, message string) string {
+		if message == "again" {
+			return "msg_duplicate"
+		}
+		return ""
+	}
+
+	tc := newTestChat(t, srv)
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tc.Join("dallas").Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Chat("dallas", "once").Wait(ctx); err != nil {
+		t.Error(err)
+	}
+
+	err = tc.Chat("dallas", "again").Wait(ctx)
+	if rejected, ok := err.(*twitchchat.RejectedError); !ok || rejected.Notice.MsgId != "msg_duplicate" {
+		t.Error("Not rejected: " + fmt.Sprint(err))
+	}
+
+	cancelled, cancelChat := context.WithCancel(context.Background())
+	cancelChat()
+	if err := tc.ChatContext(cancelled, "dallas", "never").Wait(ctx); err != context.Canceled {
+		t.Error("Wrong error for cancelled chat: " + fmt.Sprint(err))
+	}
+}
+
+func TestTwitchChatThrottled(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rejected := 0
+	srv.Reject = func(channel, message string) string {
+		switch {
+		case message == "followers":
+			return "msg_followersonly"
+		case rejected < 1:
+			rejected++
+			return "msg_slowmode"
+		}
+		return ""
+	}
+
+	tc := newTestChat(t, srv)
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tc.Join("dallas").Wait(ctx)
+
+	start := time.Now()
+	if err := tc.Chat("dallas", "slow").Wait(ctx); err != nil {
+		t.Error("Not sent again: " + err.Error())
+	}
+	if time.Since(start) < time.Second {
+		t.Error("Sent again without waiting")
+	}
+	if _, err := srv.WaitForCommand(timeout, "PRIVMSG", "#dallas", "slow"); err != nil {
+		t.Error("PRIVMSG not sent")
+	}
+
+	err = tc.Chat("dallas", "followers").Wait(ctx)
+	if rejected, ok := err.(*twitchchat.RejectedError); !ok || rejected.Retryable() {
+		t.Error("Permanent rejection not reported: " + fmt.Sprint(err))
+	}
+}
+
+func TestTwitchChatRetriedDuplicate(t *testing.T) {
+	srv, err := twitchchattest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rejected := false
+	srv.Reject = func(channel, message string) string {
+		if !rejected {
+			rejected = true
+			return "msg_slowmode"
+		}
+		return ""
+	}
+
+	tc, err := twitchchat.NewTwitchChat(&twitchchat.Options{
+		Nick:           "ronni",
+		Pass:           "secret",
+		EnableTags:     true,
+		Transport:      srv.Transport(),
+		ChatDuplicates: twitchchat.DuplicateReject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tc.Join("dallas").Wait(ctx)
+
+	if err := tc.Chat("dallas", "slow").Wait(ctx); err != nil {
+		t.Error("Not sent again: " + err.Error())
+	}
+	if err := tc.Chat("dallas", "slow").Wait(ctx); err != twitchchat.ErrDuplicate {
+		t.Error("Duplicate not rejected: " + fmt.Sprint(err))
+	}
+}
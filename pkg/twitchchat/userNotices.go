@@ -0,0 +1,186 @@
+package twitchchat
+
+// UserNotice is dispatched as one of the types below depending on its
+// msg-id. Notices with a msg-id that isn't known are dispatched as a
+// *UserNotice. Callbacks registered for *UserNotice receive every notice
+// that has no callback registered for its own type
+
+type Sub struct {
+	UserNotice
+	CumulativeMonths  int
+	ShouldShareStreak bool
+	StreakMonths      int
+	SubPlan           string // Prime, 1000, 2000 or 3000
+	SubPlanName       string
+}
+
+type Resub struct {
+	UserNotice
+	CumulativeMonths  int
+	ShouldShareStreak bool
+	StreakMonths      int
+	SubPlan           string // Prime, 1000, 2000 or 3000
+	SubPlanName       string
+}
+
+type SubGift struct {
+	UserNotice
+	Months               int
+	RecipientDisplayName string
+	RecipientId          string
+	RecipientUserName    string
+	SubPlan              string // 1000, 2000 or 3000
+	SubPlanName          string
+	GiftMonths           int
+}
+
+// AnonSubGift is a SubGift from an anonymous user
+type AnonSubGift struct {
+	UserNotice
+	Months               int
+	RecipientDisplayName string
+	RecipientId          string
+	RecipientUserName    string
+	SubPlan              string // 1000, 2000 or 3000
+	SubPlanName          string
+	GiftMonths           int
+}
+
+// SubMysteryGift is sent when a user gifts subs to random viewers. Every
+// gifted sub is followed by a SubGift
+type SubMysteryGift struct {
+	UserNotice
+	Anonymous     bool
+	MassGiftCount int
+	SenderCount   int // Total number of subs gifted in the channel
+	SubPlan       string
+}
+
+// GiftPaidUpgrade is sent when a user continues a gifted sub
+type GiftPaidUpgrade struct {
+	UserNotice
+	Anonymous      bool // The gift was from an anonymous user
+	PromoGiftTotal int
+	PromoName      string
+	SenderLogin    string
+	SenderName     string
+}
+
+type Raid struct {
+	UserNotice
+	RaiderDisplayName string
+	RaiderLogin       string
+	ViewerCount       int
+}
+
+type Ritual struct {
+	UserNotice
+	RitualName string
+}
+
+type BitsBadgeTier struct {
+	UserNotice
+	Threshold int
+}
+
+type Announcement struct {
+	UserNotice
+	AnnouncementColor string // PRIMARY, BLUE, GREEN, ORANGE or PURPLE
+}
+
+// Implemented by UserNotice and every type embedding it
+type userNoticeEvent interface {
+	userNotice() *UserNotice
+}
+
+func (msg *UserNotice) userNotice() *UserNotice {
+	return msg
+}
+
+func newUserNoticeEvent(notice *UserNotice) IrcMessage {
+	tags := notice.RawTags
+
+	switch notice.MsgId {
+	case "sub":
+		return &Sub{
+			UserNotice:        *notice,
+			CumulativeMonths:  getIntFromTags(tags, "msg-param-cumulative-months"),
+			ShouldShareStreak: getBoolFromTags(tags, "msg-param-should-share-streak"),
+			StreakMonths:      getIntFromTags(tags, "msg-param-streak-months"),
+			SubPlan:           getStringFromTags(tags, "msg-param-sub-plan"),
+			SubPlanName:       getStringFromTags(tags, "msg-param-sub-plan-name"),
+		}
+	case "resub":
+		return &Resub{
+			UserNotice:        *notice,
+			CumulativeMonths:  getIntFromTags(tags, "msg-param-cumulative-months"),
+			ShouldShareStreak: getBoolFromTags(tags, "msg-param-should-share-streak"),
+			StreakMonths:      getIntFromTags(tags, "msg-param-streak-months"),
+			SubPlan:           getStringFromTags(tags, "msg-param-sub-plan"),
+			SubPlanName:       getStringFromTags(tags, "msg-param-sub-plan-name"),
+		}
+	case "subgift":
+		return &SubGift{
+			UserNotice:           *notice,
+			Months:               getIntFromTags(tags, "msg-param-months"),
+			RecipientDisplayName: getStringFromTags(tags, "msg-param-recipient-display-name"),
+			RecipientId:          getStringFromTags(tags, "msg-param-recipient-id"),
+			RecipientUserName:    getStringFromTags(tags, "msg-param-recipient-user-name"),
+			SubPlan:              getStringFromTags(tags, "msg-param-sub-plan"),
+			SubPlanName:          getStringFromTags(tags, "msg-param-sub-plan-name"),
+			GiftMonths:           getIntFromTags(tags, "msg-param-gift-months"),
+		}
+	case "anonsubgift":
+		return &AnonSubGift{
+			UserNotice:           *notice,
+			Months:               getIntFromTags(tags, "msg-param-months"),
+			RecipientDisplayName: getStringFromTags(tags, "msg-param-recipient-display-name"),
+			RecipientId:          getStringFromTags(tags, "msg-param-recipient-id"),
+			RecipientUserName:    getStringFromTags(tags, "msg-param-recipient-user-name"),
+			SubPlan:              getStringFromTags(tags, "msg-param-sub-plan"),
+			SubPlanName:          getStringFromTags(tags, "msg-param-sub-plan-name"),
+			GiftMonths:           getIntFromTags(tags, "msg-param-gift-months"),
+		}
+	case "submysterygift", "anonsubmysterygift":
+		return &SubMysteryGift{
+			UserNotice:    *notice,
+			Anonymous:     notice.MsgId == "anonsubmysterygift",
+			MassGiftCount: getIntFromTags(tags, "msg-param-mass-gift-count"),
+			SenderCount:   getIntFromTags(tags, "msg-param-sender-count"),
+			SubPlan:       getStringFromTags(tags, "msg-param-sub-plan"),
+		}
+	case "giftpaidupgrade", "anongiftpaidupgrade":
+		return &GiftPaidUpgrade{
+			UserNotice:     *notice,
+			Anonymous:      notice.MsgId == "anongiftpaidupgrade",
+			PromoGiftTotal: getIntFromTags(tags, "msg-param-promo-gift-total"),
+			PromoName:      getStringFromTags(tags, "msg-param-promo-name"),
+			SenderLogin:    getStringFromTags(tags, "msg-param-sender-login"),
+			SenderName:     getStringFromTags(tags, "msg-param-sender-name"),
+		}
+	case "raid":
+		return &Raid{
+			UserNotice:        *notice,
+			RaiderDisplayName: getStringFromTags(tags, "msg-param-displayName"),
+			RaiderLogin:       getStringFromTags(tags, "msg-param-login"),
+			ViewerCount:       getIntFromTags(tags, "msg-param-viewerCount"),
+		}
+	case "ritual":
+		return &Ritual{
+			UserNotice: *notice,
+			RitualName: getStringFromTags(tags, "msg-param-ritual-name"),
+		}
+	case "bitsbadgetier":
+		return &BitsBadgeTier{
+			UserNotice: *notice,
+			Threshold:  getIntFromTags(tags, "msg-param-threshold"),
+		}
+	case "announcement":
+		return &Announcement{
+			UserNotice:        *notice,
+			AnnouncementColor: getStringFromTags(tags, "msg-param-color"),
+		}
+	}
+
+	return notice
+}
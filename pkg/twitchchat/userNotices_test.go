@@ -0,0 +1,90 @@
+package twitchchat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_newUserNoticeEvent(t *testing.T) {
+	var bytes []byte
+	var ircMsg IrcMessage
+
+	bytes = []byte("@badge-info=;badges=staff/1,broadcaster/1,turbo/1;color=#008000;display-name=ronni;emotes=;id=db25007f-7a18-43eb-9379-80131e44d633;login=ronni;mod=0;msg-id=resub;msg-param-cumulative-months=6;msg-param-streak-months=2;msg-param-should-share-streak=1;msg-param-sub-plan=Prime;msg-param-sub-plan-name=Prime;room-id=1337;subscriber=1;system-msg=ronni\\shas\\ssubscribed\\sfor\\s6\\smonths!;tmi-sent-ts=1507246572675;turbo=1;user-id=1337;user-type=staff :tmi.twitch.tv USERNOTICE #dallas :Great stream -- keep it up!")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*Resub); ok {
+		if msg.CumulativeMonths != 6 || msg.StreakMonths != 2 || !msg.ShouldShareStreak {
+			t.Error("Wrong months")
+		}
+		if msg.SubPlan != "Prime" || msg.SubPlanName != "Prime" {
+			t.Error("Wrong sub plan")
+		}
+		if msg.Channel != "dallas" || msg.Message != "Great stream -- keep it up!" {
+			t.Error("Wrong user notice")
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("Resub unsuccessfully parsed")
+	}
+
+	bytes = []byte("@badge-info=;badges=staff/1,premium/1;color=#0000FF;display-name=TWW2;emotes=;id=e9176cd8-5e22-4684-ad40-ce53c2561c5e;login=tww2;mod=0;msg-id=subgift;msg-param-months=1;msg-param-recipient-display-name=Mr_Woodchuck;msg-param-recipient-id=55554444;msg-param-recipient-user-name=mr_woodchuck;msg-param-sub-plan-name=House\\sof\\sNyoro~n;msg-param-sub-plan=1000;room-id=19571752;subscriber=0;system-msg=TWW2\\sgifted\\sa\\sTier\\s1\\ssub\\sto\\sMr_Woodchuck!;tmi-sent-ts=1521159445153;turbo=0;user-id=87654321;user-type=staff :tmi.twitch.tv USERNOTICE #forstycup")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*SubGift); ok {
+		if msg.RecipientDisplayName != "Mr_Woodchuck" || msg.RecipientId != "55554444" || msg.RecipientUserName != "mr_woodchuck" {
+			t.Error("Wrong recipient")
+		}
+		if msg.SubPlan != "1000" || msg.SubPlanName != "House of Nyoro~n" || msg.Months != 1 {
+			t.Error("Wrong sub plan")
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("SubGift unsuccessfully parsed")
+	}
+
+	bytes = []byte("@badge-info=;badges=turbo/1;color=#9ACD32;display-name=TestChannel;emotes=;id=3d830f12-795c-447d-af3c-ea05e40fbddb;login=testchannel;mod=0;msg-id=raid;msg-param-displayName=TestChannel;msg-param-login=testchannel;msg-param-viewerCount=15;room-id=33332222;subscriber=0;system-msg=15\\sraiders\\sfrom\\sTestChannel\\shave\\sjoined\\n!;tmi-sent-ts=1507246572675;turbo=1;user-id=123456;user-type= :tmi.twitch.tv USERNOTICE #othertestchannel")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*Raid); ok {
+		if msg.RaiderDisplayName != "TestChannel" || msg.RaiderLogin != "testchannel" || msg.ViewerCount != 15 {
+			t.Error("Wrong raider")
+		}
+		if msg.Channel != "othertestchannel" {
+			t.Error("Wrong channel")
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("Raid unsuccessfully parsed")
+	}
+
+	bytes = []byte("@badge-info=;badges=;color=;display-name=SevenTest1;emotes=30259:0-6;id=37feed0f-b9c7-4c3a-b475-21c6c6d21c3d;login=seventest1;mod=0;msg-id=ritual;msg-param-ritual-name=new_chatter;room-id=87654321;subscriber=0;system-msg=Seventoes\\sis\\snew\\shere!;tmi-sent-ts=1508363903826;turbo=0;user-id=77776666;user-type= :tmi.twitch.tv USERNOTICE #seventoes :HeyGuys")
+	ircMsg = bytesToIrcMessage(bytes)
+	if msg, ok := ircMsg.(*Ritual); ok {
+		if msg.RitualName != "new_chatter" {
+			t.Error("Wrong ritual name")
+		}
+		if len(msg.Emotes) != 1 || msg.Emotes[0].Text != "HeyGuys" {
+			t.Error("Wrong emotes")
+		}
+	} else {
+		fmt.Printf("%T\n", ircMsg)
+		t.Error("Ritual unsuccessfully parsed")
+	}
+
+	bytes = []byte("@msg-id=bitsbadgetier;msg-param-threshold=10000 :tmi.twitch.tv USERNOTICE #dallas")
+	if msg, ok := bytesToIrcMessage(bytes).(*BitsBadgeTier); !ok || msg.Threshold != 10000 {
+		t.Error("BitsBadgeTier unsuccessfully parsed")
+	}
+
+	bytes = []byte("@msg-id=announcement;msg-param-color=PRIMARY;color=#FF0000 :tmi.twitch.tv USERNOTICE #dallas :Hello")
+	if msg, ok := bytesToIrcMessage(bytes).(*Announcement); !ok || msg.AnnouncementColor != "PRIMARY" || msg.Color.String() != "#FF0000" {
+		t.Error("Announcement unsuccessfully parsed")
+	}
+
+	bytes = []byte("@msg-id=anonsubmysterygift;msg-param-mass-gift-count=5;msg-param-sub-plan=1000 :tmi.twitch.tv USERNOTICE #dallas")
+	if msg, ok := bytesToIrcMessage(bytes).(*SubMysteryGift); !ok || !msg.Anonymous || msg.MassGiftCount != 5 {
+		t.Error("SubMysteryGift unsuccessfully parsed")
+	}
+
+	bytes = []byte("@msg-id=somethingnew :tmi.twitch.tv USERNOTICE #dallas")
+	if msg, ok := bytesToIrcMessage(bytes).(*UserNotice); !ok || msg.MsgId != "somethingnew" {
+		t.Error("Unknown user notice unsuccessfully parsed")
+	}
+}
@@ -0,0 +1,580 @@
+// Package twitchchattest provides a fake twitch chat server so that clients
+// built on twitchchat can be tested without connecting to twitch
+package twitchchattest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beardsleyn/go-twitch/pkg/twitchchat"
+)
+
+var ErrTimeout = errors.New("timed out")
+
+// Message is a single irc message sent by a client
+type Message struct {
+	Raw     string
+	Tags    map[string]string
+	Command string
+	Params  []string
+}
+
+// Server is a fake twitch chat server listening on a local TCP port. It
+// speaks enough of the twitch irc protocol for a client to log in, join and
+// part channels and chat, and records everything clients send
+type Server struct {
+	// Password clients have to log in with, without the "oauth:" prefix.
+	// Any password is accepted when empty
+	Pass string
+	// Decides whether a chat message is rejected, returning the msg-id of
+	// the NOTICE to reject it with, such as "msg_duplicate", or "" to accept
+	// it. Every message is accepted when nil
+	Reject func(channel, message string) string
+
+	listener net.Listener
+	msgId    int
+	received []Message
+	clients  map[*client]bool
+	closed   bool
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	wg       sync.WaitGroup
+}
+
+type client struct {
+	conn     net.Conn
+	pass     string
+	mutex    sync.Mutex // Guards nick, tags and channels, which other clients read
+	nick     string
+	tags     bool
+	channels map[string]bool
+}
+
+// NewServer starts a server on a random local port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		clients:  make(map[*client]bool),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Transport connects to the server. Pass it in twitchchat.Options
+func (s *Server) Transport() twitchchat.Transport {
+	return &twitchchat.TCPTransport{Addr: s.Addr()}
+}
+
+// Close stops listening and drops every client
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Clients returns the number of connected clients
+func (s *Server) Clients() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.clients)
+}
+
+// DropClients closes the connection of every client, as if twitch went away
+func (s *Server) DropClients() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Received returns every message sent by clients so far
+func (s *Server) Received() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Message(nil), s.received...)
+}
+
+// WaitFor blocks until a client has sent a message matching match, checking
+// messages that were already received as well
+func (s *Server) WaitFor(timeout time.Duration, match func(msg Message) bool) (Message, error) {
+	timer := time.AfterFunc(timeout, func() {
+		s.mutex.Lock()
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; ; {
+		for ; i < len(s.received); i++ {
+			if match(s.received[i]) {
+				return s.received[i], nil
+			}
+		}
+		if s.closed || !time.Now().Before(deadline) {
+			return Message{}, ErrTimeout
+		}
+		s.cond.Wait()
+	}
+}
+
+// WaitForCommand blocks until a client has sent command. For commands that
+// target a channel the first param has to match params[0] and so on
+func (s *Server) WaitForCommand(timeout time.Duration, command string, params ...string) (Message, error) {
+	return s.WaitFor(timeout, func(msg Message) bool {
+		if msg.Command != command || len(msg.Params) < len(params) {
+			return false
+		}
+		for i := range params {
+			if msg.Params[i] != params[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Send writes a raw line to every client
+func (s *Server) Send(line string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.clients {
+		c.write(line)
+	}
+}
+
+// SendToChannel writes a raw line to every client that joined channel
+func (s *Server) SendToChannel(channel, line string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.clients {
+		if c.joined(channel) {
+			c.write(line)
+		}
+	}
+}
+
+// SendPrivmsg sends a chat message from user to channel. tags are added to,
+// or replace, the tags twitch would send. Returns the id of the message
+func (s *Server) SendPrivmsg(channel, user, message string, tags map[string]string) string {
+	id := s.nextMsgId()
+	msgTags := userTags(channel, user, id)
+	for key, val := range tags {
+		msgTags[key] = val
+	}
+	s.SendToChannel(channel, formatTags(msgTags)+
+		":"+user+"!"+user+"@"+user+".tmi.twitch.tv PRIVMSG #"+channel+" :"+message)
+	return msgTags["id"]
+}
+
+// SendUserNotice sends a user notice such as a sub or raid. msgId is the
+// kind of notice, e.g. "sub", "resub" or "raid". Params specific to the kind
+// of notice go in tags, e.g. "msg-param-cumulative-months". Returns the id of
+// the message
+func (s *Server) SendUserNotice(channel, user, msgId, systemMsg, message string, tags map[string]string) string {
+	id := s.nextMsgId()
+	msgTags := userTags(channel, user, id)
+	msgTags["login"] = user
+	msgTags["msg-id"] = msgId
+	msgTags["system-msg"] = systemMsg
+	for key, val := range tags {
+		msgTags[key] = val
+	}
+
+	line := formatTags(msgTags) + ":tmi.twitch.tv USERNOTICE #" + channel
+	if message != "" {
+		line += " :" + message
+	}
+	s.SendToChannel(channel, line)
+	return msgTags["id"]
+}
+
+// SendClearChat purges every message of user in channel, or the whole chat
+// when user is empty. A duration of zero is a permanent ban
+func (s *Server) SendClearChat(channel, user string, duration time.Duration) {
+	tags := map[string]string{
+		"room-id":     roomId(channel),
+		"tmi-sent-ts": timestamp(),
+	}
+	if duration > 0 {
+		tags["ban-duration"] = strconv.Itoa(int(duration / time.Second))
+	}
+
+	line := formatTags(tags) + ":tmi.twitch.tv CLEARCHAT #" + channel
+	if user != "" {
+		line += " :" + user
+	}
+	s.SendToChannel(channel, line)
+}
+
+// SendReconnect tells every client to reconnect. Like twitch the server
+// keeps the connections open until the clients close them or DropClients is
+// called
+func (s *Server) SendReconnect() {
+	s.Send(":tmi.twitch.tv RECONNECT")
+}
+
+func (s *Server) nextMsgId() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.msgId++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", s.msgId)
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &client{
+			conn:     conn,
+			channels: make(map[string]bool),
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = true
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.clients, c)
+		s.mutex.Unlock()
+		c.conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		msg := parseMessage(line)
+		s.mutex.Lock()
+		s.received = append(s.received, msg)
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+
+		if !s.handle(c, msg) {
+			return
+		}
+	}
+}
+
+// handle answers msg the way twitch would. Returns false if the connection
+// has to be closed
+func (s *Server) handle(c *client, msg Message) bool {
+	switch msg.Command {
+	case "CAP":
+		if len(msg.Params) > 1 && msg.Params[0] == "REQ" {
+			for _, capability := range strings.Fields(msg.Params[1]) {
+				if capability == "twitch.tv/tags" {
+					c.mutex.Lock()
+					c.tags = true
+					c.mutex.Unlock()
+				}
+			}
+			c.write(":tmi.twitch.tv CAP * ACK :" + msg.Params[1])
+		}
+	case "PASS":
+		if len(msg.Params) > 0 {
+			c.pass = strings.TrimPrefix(msg.Params[0], "oauth:")
+		}
+	case "NICK":
+		if len(msg.Params) == 0 {
+			return false
+		}
+		if s.Pass != "" && c.pass != s.Pass {
+			c.write(":tmi.twitch.tv NOTICE * :Login authentication failed")
+			return false
+		}
+
+		c.mutex.Lock()
+		c.nick = strings.ToLower(msg.Params[0])
+		c.mutex.Unlock()
+		for _, line := range []string{
+			"001 " + c.nick + " :Welcome, GLHF!",
+			"002 " + c.nick + " :Your host is tmi.twitch.tv",
+			"003 " + c.nick + " :This server is rather new",
+			"004 " + c.nick + " :-",
+			"375 " + c.nick + " :-",
+			"372 " + c.nick + " :You are in a maze of twisty passages, all alike.",
+			"376 " + c.nick + " :>",
+		} {
+			c.write(":tmi.twitch.tv " + line)
+		}
+		if c.wantsTags() {
+			c.write("@badge-info=;badges=;color=;display-name=" + c.nick +
+				";emote-sets=0;user-id=" + roomId(c.nick) + ";user-type= :tmi.twitch.tv GLOBALUSERSTATE")
+		}
+	case "JOIN":
+		if len(msg.Params) == 0 {
+			return true
+		}
+		for _, channel := range strings.Split(msg.Params[0], ",") {
+			channel = channelName(channel)
+
+			c.mutex.Lock()
+			c.channels[channel] = true
+			c.mutex.Unlock()
+
+			prefix := ":" + c.nick + "!" + c.nick + "@" + c.nick + ".tmi.twitch.tv"
+			c.write(prefix + " JOIN #" + channel)
+			c.write(":" + c.nick + ".tmi.twitch.tv 353 " + c.nick + " = #" + channel + " :" + c.nick)
+			c.write(":" + c.nick + ".tmi.twitch.tv 366 " + c.nick + " #" + channel + " :End of /NAMES list")
+			if c.wantsTags() {
+				c.write(c.userState(channel))
+				c.write("@emote-only=0;followers-only=-1;r9k=0;room-id=" + roomId(channel) +
+					";slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #" + channel)
+			}
+		}
+	case "PART":
+		if len(msg.Params) == 0 {
+			return true
+		}
+		for _, channel := range strings.Split(msg.Params[0], ",") {
+			channel = channelName(channel)
+
+			c.mutex.Lock()
+			delete(c.channels, channel)
+			c.mutex.Unlock()
+
+			c.write(":" + c.nick + "!" + c.nick + "@" + c.nick + ".tmi.twitch.tv PART #" + channel)
+		}
+	case "PRIVMSG":
+		if len(msg.Params) < 2 {
+			return true
+		}
+		channel := channelName(msg.Params[0])
+		if s.Reject != nil {
+			if msgId := s.Reject(channel, msg.Params[1]); msgId != "" {
+				text, ok := noticeTexts[msgId]
+				if !ok {
+					text = "Your message was not sent"
+				}
+				c.write("@msg-id=" + msgId + " :tmi.twitch.tv NOTICE #" + channel + " :" + text)
+				return true
+			}
+		}
+		if c.wantsTags() {
+			c.write(c.userState(channel))
+		}
+
+		// Pass the message on to every other client in the channel, along
+		// with any tags the sender added
+		id := s.nextMsgId()
+		tags := userTags(channel, c.nick, id)
+		for key, val := range msg.Tags {
+			tags[strings.TrimPrefix(key, "+")] = val
+		}
+		line := ":" + c.nick + "!" + c.nick + "@" + c.nick + ".tmi.twitch.tv PRIVMSG #" + channel + " :" + msg.Params[1]
+
+		s.mutex.Lock()
+		for other := range s.clients {
+			if other != c && other.joined(channel) {
+				if other.wantsTags() {
+					other.write(formatTags(tags) + line)
+				} else {
+					other.write(line)
+				}
+			}
+		}
+		s.mutex.Unlock()
+	case "PING":
+		arg := "tmi.twitch.tv"
+		if len(msg.Params) > 0 {
+			arg = msg.Params[0]
+		}
+		c.write(":tmi.twitch.tv PONG tmi.twitch.tv :" + arg)
+	case "PONG":
+	default:
+		c.write(":tmi.twitch.tv 421 " + c.nick + " " + msg.Command + " :Unknown command")
+	}
+	return true
+}
+
+// Texts of the NOTICEs chat messages are rejected with, slow mode always asks
+// to wait one second
+var noticeTexts = map[string]string{
+	"msg_duplicate": "Your message was not sent because it is identical to the previous one you sent, less than 30 seconds ago.",
+	"msg_ratelimit": "Your message was not sent because you are sending messages too quickly.",
+	"msg_slowmode":  "This room is in slow mode and you are sending messages too quickly. You will be able to talk again in 1 seconds.",
+}
+
+// channelName returns channel the way twitch echoes it, lowercase and
+// without the leading #
+func channelName(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(channel, "#"))
+}
+
+func (c *client) write(line string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+func (c *client) wantsTags() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tags
+}
+
+func (c *client) joined(channel string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.channels[channelName(channel)]
+}
+
+func (c *client) userState(channel string) string {
+	return "@badge-info=;badges=;color=;display-name=" + c.nick +
+		";emote-sets=0;mod=0;subscriber=0;user-type= :tmi.twitch.tv USERSTATE #" + channel
+}
+
+func userTags(channel, user, id string) map[string]string {
+	return map[string]string{
+		"badge-info":   "",
+		"badges":       "",
+		"color":        "",
+		"display-name": user,
+		"emotes":       "",
+		"id":           id,
+		"mod":          "0",
+		"room-id":      roomId(channel),
+		"subscriber":   "0",
+		"tmi-sent-ts":  timestamp(),
+		"turbo":        "0",
+		"user-id":      roomId(user),
+		"user-type":    "",
+	}
+}
+
+// roomId makes up a stable numeric id for a channel or user name
+func roomId(name string) string {
+	var id uint32 = 2166136261
+	for i := 0; i < len(name); i++ {
+		id = (id ^ uint32(name[i])) * 16777619
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func timestamp() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+var tagUnescaper = strings.NewReplacer(
+	"\\\\", "\\",
+	"\\:", ";",
+	"\\s", " ",
+	"\\r", "\r",
+	"\\n", "\n",
+)
+
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for key, val := range tags {
+		pairs = append(pairs, key+"="+tagEscaper.Replace(val))
+	}
+	return "@" + strings.Join(pairs, ";") + " "
+}
+
+func parseMessage(line string) Message {
+	msg := Message{
+		Raw:  line,
+		Tags: make(map[string]string),
+	}
+
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line = cut(line[1:])
+		for _, tag := range strings.Split(tags, ";") {
+			keyVal := strings.SplitN(tag, "=", 2)
+			if len(keyVal) == 2 {
+				msg.Tags[keyVal[0]] = tagUnescaper.Replace(keyVal[1])
+			} else {
+				msg.Tags[keyVal[0]] = ""
+			}
+		}
+	}
+
+	if strings.HasPrefix(line, ":") {
+		_, line = cut(line)
+	}
+
+	msg.Command, line = cut(line)
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+
+		var param string
+		param, line = cut(line)
+		msg.Params = append(msg.Params, param)
+	}
+
+	return msg
+}
+
+// cut splits s at the first space
+func cut(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], strings.TrimLeft(s[i+1:], " ")
+	}
+	return s, ""
+}
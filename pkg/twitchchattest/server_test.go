@@ -0,0 +1,98 @@
+package twitchchattest
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const timeout = 5 * time.Second
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// dial logs in to srv as nick, asking for tags
+func dial(t *testing.T, srv *Server, nick, pass string) *testClient {
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+	c.send("CAP REQ :twitch.tv/tags twitch.tv/commands")
+	c.send("PASS oauth:" + pass)
+	c.send("NICK " + nick)
+	return c
+}
+
+func (c *testClient) send(line string) {
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// waitFor reads lines until one contains text
+func (c *testClient) waitFor(text string) Message {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for c.scanner.Scan() {
+		if line := c.scanner.Text(); strings.Contains(line, text) {
+			return parseMessage(line)
+		}
+	}
+	c.t.Fatal("Never received " + text)
+	return Message{}
+}
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Pass = "secret"
+
+	ronni := dial(t, srv, "Ronni", "secret")
+	if msg := ronni.waitFor(" 001 "); len(msg.Params) == 0 || msg.Params[0] != "ronni" {
+		t.Error("Wrong welcome: " + msg.Raw)
+	}
+	ronni.waitFor("GLOBALUSERSTATE")
+
+	ronni.send("JOIN #Dallas")
+	if msg := ronni.waitFor(" JOIN "); msg.Params[0] != "#dallas" {
+		t.Error("Wrong join echo: " + msg.Raw)
+	}
+	if msg := ronni.waitFor("ROOMSTATE"); msg.Params[0] != "#dallas" {
+		t.Error("Wrong room state: " + msg.Raw)
+	}
+
+	emma := dial(t, srv, "emma", "secret")
+	emma.send("JOIN #dallas")
+	emma.waitFor(" JOIN ")
+	if srv.Clients() != 2 {
+		t.Error("Wrong client count: " + strconv.Itoa(srv.Clients()))
+	}
+
+	ronni.send("@+reply=1 PRIVMSG #DALLAS :hello")
+	msg := emma.waitFor("PRIVMSG")
+	if msg.Params[0] != "#dallas" || msg.Params[1] != "hello" {
+		t.Error("Wrong relayed message: " + msg.Raw)
+	}
+	if msg.Tags["display-name"] != "ronni" || msg.Tags["reply"] != "1" || msg.Tags["id"] == "" {
+		t.Error("Wrong relayed tags: " + msg.Raw)
+	}
+	if _, err := srv.WaitForCommand(timeout, "PRIVMSG", "#DALLAS", "hello"); err != nil {
+		t.Error("Message not recorded: " + err.Error())
+	}
+
+	wrong := dial(t, srv, "mallory", "guess")
+	if msg := wrong.waitFor("NOTICE"); msg.Params[1] != "Login authentication failed" {
+		t.Error("Wrong login failure: " + msg.Raw)
+	}
+}